@@ -0,0 +1,38 @@
+#!/bin/sh
+set -e
+
+if [ "$MODE" = "events" ] && [ "$1" = "/usr/sbin/crond" ]; then
+  set -- /usr/local/bin/ghbackup
+fi
+
+PUID=${PUID:-0}
+PGID=${PGID:-0}
+
+if [ "$PUID" = "0" ]; then
+  exec "$@"
+fi
+
+if ! getent group "$PGID" > /dev/null; then
+  addgroup -g "$PGID" ghbackup
+fi
+
+if ! getent passwd "$PUID" > /dev/null; then
+  adduser -D -h /home/ghbackup -u "$PUID" -G "$(getent group "$PGID" | cut -d: -f1)" ghbackup
+fi
+
+user=$(getent passwd "$PUID" | cut -d: -f1)
+home=$(getent passwd "$PUID" | cut -d: -f6)
+
+mkdir -p "$home"
+chown "$PUID:$PGID" "$home"
+
+if [ -f /etc/crontabs/root ]; then
+  mv /etc/crontabs/root "/etc/crontabs/$user"
+fi
+
+if [ "$1" = "/usr/sbin/crond" ]; then
+  exec "$@"
+fi
+
+export HOME="$home"
+exec su-exec "$PUID:$PGID" "$@"
@@ -2,43 +2,4651 @@
 
 require 'octokit'
 require 'uri'
+require 'json'
+require 'fileutils'
+require 'open3'
+require 'time'
+require 'find'
+require 'net/http'
+require 'openssl'
+require 'base64'
+require 'socket'
+require 'digest'
+require 'etc'
+require 'erb'
+require 'shellwords'
 
-lock_file = File.open("/tmp/ghbackup.lock", File::CREAT)
-lock_state = lock_file.flock(File::LOCK_EX|File::LOCK_NB)
+VERSION = ENV["GHBACKUP_VERSION"] || "dev"
+REVISION = ENV["GHBACKUP_REVISION"] || begin
+  Open3.capture2('git', '-C', File.dirname(File.realpath(__FILE__)), 'rev-parse', '--short', 'HEAD', err: File::NULL).first.strip
+rescue SystemCallError
+  "unknown"
+end
+BUILD_DATE = ENV["GHBACKUP_BUILD_DATE"]
+RELEASES_REPOSITORY = "digitalpardoe/docker-ghbackup"
+NOTES_REFS = %w[refs/notes/* refs/replace/*]
+RATE_LIMIT_ERRORS = [Octokit::TooManyRequests, Octokit::AbuseDetected]
+READ_ONLY_COMMANDS = %w[restore search serve status list-runs login verify healthcheck compare version restore-settings config simulate deep-verify checkout cat check-listing]
+DEPRECATED_SETTINGS = {
+  "GITHUB_SECRET" => "GITHUB_TOKEN"
+}
+SECRET_SETTINGS = %w[GITHUB_TOKEN VAULT_TOKEN VAULT_SECRET_ID NOTIFY_WEBHOOK_URL NOTIFY_COMMAND HOST_STATUS_URL HOST_STATUS_TOKEN]
+# Every setting read from the environment, documented by ghbackup config docs.
+# Defaults are given as they would be written in the environment.
+CONFIG_SCHEMA = {
+  "ACTIVITY_LOG" => { type: :integer, default: "0", description: "number of commit subjects to list per updated branch in the activity digest" },
+  "AGE_IDENTITY" => { type: :string, description: "path to the age identity file used by `ghbackup restore`" },
+  "AGE_RECIPIENTS" => { type: :list, description: "space or comma separated age recipients, enables encrypted backups when set" },
+  "API_OPEN_TIMEOUT" => { type: :integer, default: "10", description: "seconds to wait for a connection to the GitHub API to open" },
+  "API_TIMEOUT" => { type: :integer, default: "60", description: "seconds to wait for a GitHub API response before giving up on the request" },
+  "BACKUP_FOLDER" => { type: :string, default: "/ghbackup", description: "folder to store the GitHub backups in" },
+  "BACKUP_INTERVAL" => { type: :number, default: "0", description: "minimum number of hours between runs, `24` by default with `MODE=events`" },
+  "BACKUP_WINDOW" => { type: :window, description: "time window in the container's local time, as `HH:MM-HH:MM`, during which repositories are transferred" },
+  "CANARY_REPO" => { type: :string, description: "small repository (`<owner>/<repo>`) backed up, verified and test restored before anything else, the run stops early if it fails" },
+  "CHECK_GITHUB_STATUS" => { type: :boolean, description: "set to `true` to wait out GitHub incidents before a run" },
+  "COLLECTOR_BUDGET" => { type: :integer, default: "0", description: "percentage of the API rate limit remaining at the start of a run that the metadata exports may use, shared equally between the enabled exports, exports that use up their share are deferred to the next run" },
+  "COMMAND_LOGS" => { type: :boolean, description: "set to `true` to keep the full output of the commands run for each repository in `.ghbackup/logs/<owner>/<repo>.log`, the last lines of the output are always included in the report when a repository fails" },
+  "COMMIT_STATUS_DEPTH" => { type: :integer, default: "10", description: "number of recent commits on the default branch to export statuses for" },
+  "DEEP_VERIFY_INTERVAL" => { type: :days, default: "0", description: "days (e.g. `30d`) between deep verifications of every mirror and encrypted artifact, with repairs, at the end of a run" },
+  "DELAYED_MIRROR" => { type: :days, default: "0", description: "days (e.g. `7d`) the delayed copy of each mirror lags behind" },
+  "ENTERPRISE" => { type: :string, description: "slug of a GitHub Enterprise (e.g. an Enterprise Managed Users enterprise), when set the repositories of every organization in the enterprise visible to the token are backed up instead of the user's repositories" },
+  "EVENTS_INTERVAL" => { type: :integer, default: "60", description: "seconds between polls of the events API in `events` mode, GitHub's requested poll interval is used if it's longer" },
+  "EXPORT_ACCOUNT" => { type: :boolean, description: "set to `true` to export the user's profile, public SSH and GPG keys, email settings, followers, following and organization and team memberships to `_account/`" },
+  "EXPORT_AUDIT_LOG" => { type: :boolean, description: "set to `true` to export the audit logs of the organizations the user owns" },
+  "EXPORT_COMMIT_STATUSES" => { type: :boolean, description: "set to `true` to export commit statuses and check runs to `_metadata/<owner>/<repo>/commit_statuses.json` in the backup folder" },
+  "EXPORT_DEPLOYMENTS" => { type: :boolean, description: "set to `true` to export environments, deployments and deployment statuses to `_metadata/<owner>/<repo>/deployments.json` in the backup folder" },
+  "EXPORT_DIR" => { type: :string, description: "folder (e.g. a mounted object storage bucket) to export plaintext mirrors to, packfiles are stored once under `packs/` by their hash and each run writes a small ref manifest to `runs/`" },
+  "EXPORT_ORG_INTEGRATIONS" => { type: :boolean, description: "set to `true` to export the webhooks and GitHub App installations of the organizations the user owns" },
+  "EXPORT_SETTINGS" => { type: :boolean, description: "set to `true` to export repository settings to `_metadata/<owner>/<repo>/settings.json` in the backup folder" },
+  "FETCH_TIMEOUT" => { type: :number, default: "0", description: "minutes a clone or fetch of a single repository may take before it's stopped" },
+  "FS_SNAPSHOT" => { type: :enum, values: %w[zfs btrfs], description: "filesystem to snapshot the backup folder with after every fully successful run" },
+  "FS_SNAPSHOT_KEEP" => { type: :integer, default: "7", description: "number of filesystem snapshots to keep" },
+  "FS_SNAPSHOT_TARGET" => { type: :string, description: "the ZFS dataset, or the directory Btrfs snapshots are created in" },
+  "GITHUB_APP_ID" => { type: :string, description: "ID of the GitHub App for `TOKEN_PROVIDER=app`" },
+  "GITHUB_APP_INSTALLATION_ID" => { type: :string, description: "ID of the app's installation to back up" },
+  "GITHUB_APP_PRIVATE_KEY" => { type: :string, description: "path to the app's private key (PEM)" },
+  "GITHUB_CLIENT_ID" => { type: :string, description: "client ID of the OAuth app used by `ghbackup login`" },
+  "GITHUB_STATUS_MAX_DELAY" => { type: :number, default: "60", description: "minutes to wait for a GitHub incident to clear before running anyway" },
+  "GITHUB_TOKEN" => { type: :string, description: "a personal access token for the GitHub user" },
+  "GITHUB_TOKEN_FILE" => { type: :string, description: "file holding the token for `TOKEN_PROVIDER=file`" },
+  "HEALTHCHECK_MAX_AGE" => { type: :number, default: "12", description: "hours since the last run started after which `ghbackup healthcheck` reports the container as unhealthy" },
+  "HOST_NAME" => { type: :string, description: "name the host's status is published under, defaults to the hostname" },
+  "HOST_STATUS_DIR" => { type: :string, description: "folder shared between hosts that each host publishes its status to, read by `ghbackup status --all-hosts`" },
+  "HOST_STATUS_TOKEN" => { type: :string, description: "shared secret hosts send with their status to `HOST_STATUS_URL`, `ghbackup serve` only accepts statuses posted with it" },
+  "HOST_STATUS_URL" => { type: :string, description: "`/api/hosts` URL of the `ghbackup serve` collecting the status of every host" },
+  "INCLUDE_NOTES" => { type: :boolean, default: "true", description: "set to `false` to leave git notes and replace refs out of partial backups" },
+  "KEEP_PREVIOUS" => { type: :boolean, description: "set to `true` to keep the previous run's copy of each mirror as `<repo>.git.prev`" },
+  "KEY_GENERATION" => { type: :integer, default: "1", description: "generation number of the current `AGE_RECIPIENTS`, recorded in the manifest and used by `ghbackup rekey`" },
+  "LAYOUT" => { type: :enum, values: %w[flat sharded], default: "flat", description: "how mirrors are laid out in the backup folder, `<owner>/<repo>.git` or `<sh>/<owner>/<repo>.git`" },
+  "LINKED_SNAPSHOTS" => { type: :integer, default: "0", description: "number of hard linked point-in-time snapshots of the mirrors to keep" },
+  "LIST_BACKEND" => { type: :enum, values: %w[rest graphql], default: "rest", description: "API used to list repositories, the GraphQL API lists repositories in far fewer requests for large accounts" },
+  "MAX_API_CALLS" => { type: :integer, default: "0", description: "GitHub API calls after which a run stops starting new repositories, `0` for no limit" },
+  "MAX_REFS" => { type: :integer, default: "0", description: "skip repositories with more refs than this" },
+  "MAX_RUN_DURATION" => { type: :number, default: "0", description: "hours after which a run stops starting new repositories, the repositories it didn't get to are backed up first in the next run" },
+  "MAX_TOTAL_SIZE" => { type: :size, description: "maximum size of the backup folder (e.g. `500G`), once it would be exceeded new repositories aren't backed up and the run reports an error, existing repositories are still updated" },
+  "MAX_TRANSFER_GB" => { type: :number, default: "0", description: "gigabytes fetched after which a run stops starting new repositories, `0` for no limit" },
+  "MODE" => { type: :enum, values: %w[scheduled events snapshot], default: "scheduled", description: "back up on a schedule, while watching for events, or as snapshots without history" },
+  "NAME_NORMALIZATION" => { type: :enum, values: %w[none lowercase encode], default: "none", description: "store mirrors and encrypted artifacts under their names as they are, lowercased, or lowercased with dots percent-encoded" },
+  "NEW_REPOSITORIES" => { type: :enum, values: %w[include approve], default: "include", description: "back up new repositories straight away or wait for `ghbackup approve`" },
+  "NOTIFIER_PLUGINS" => { type: :list, description: "space or comma separated Ruby files that register additional notifiers" },
+  "NOTIFY" => { type: :list, description: "space or comma separated notifiers to send a message to after each run, `webhook`, `command` or one added by `NOTIFIER_PLUGINS`" },
+  "NOTIFY_COMMAND" => { type: :string, description: "command run by the `command` notifier with the message on stdin and the subject in `GHBACKUP_SUBJECT`" },
+  "NOTIFY_ON" => { type: :enum, values: %w[failures always], default: "failures", description: "notify only about runs with failures or warnings, or about every run" },
+  "NOTIFY_TEMPLATES" => { type: :string, description: "folder of ERB templates, `<notifier>.subject.erb` and `<notifier>.body.erb`, used instead of the built in messages" },
+  "NOTIFY_WEBHOOK_URL" => { type: :string, description: "URL the `webhook` notifier posts the message and the run report to as JSON" },
+  "OUTPUT" => { type: :enum, values: %w[text gha jsonl], default: "text", description: "format of the run output, plain text, GitHub Actions annotations or JSON lines" },
+  "PRUNE_ARCHIVE_DAYS" => { type: :integer, default: "90", description: "age in days after which tagged archives are offered for removal by `ghbackup prune`" },
+  "PRUNE_GRACE" => { type: :days, default: "0", description: "days (e.g. `30d`) a repository has to be missing, across at least two runs, before `ghbackup prune` removes its backups" },
+  "QUOTA_EVICTION" => { type: :enum, values: %w[none archives], default: "none", description: "remove the oldest tagged archives to make room when `MAX_TOTAL_SIZE` would be exceeded" },
+  "READ_ONLY" => { type: :boolean, description: "set to `true` to refuse any command that changes the backup folder" },
+  "REPO" => { type: :string, description: "back up only this repository (`<owner>/<repo>`) without listing the others" },
+  "REPO_CONFIG" => { type: :string, description: "path to a JSON file with per-repository settings" },
+  "REPO_EXCLUDE" => { type: :list, description: "space or comma separated glob patterns, matching repositories are skipped" },
+  "REPO_INCLUDE" => { type: :list, description: "space or comma separated glob patterns (e.g. `my-org/*`), only matching repositories are backed up" },
+  "RUN_HISTORY" => { type: :integer, default: "100", description: "number of runs to keep in the history, `0` for no limit" },
+  "RUN_HISTORY_DAYS" => { type: :integer, default: "0", description: "number of days of runs to keep in the history, `0` for no limit" },
+  "RUN_TAG" => { type: :string, description: "tag recorded against the run, also used by `ghbackup restore` to pick a tagged encrypted artifact" },
+  "SEARCH_INDEX" => { type: :boolean, description: "set to `true` to index the default branch of each plaintext mirror after it's fetched, so `ghbackup search` only greps the files that can match" },
+  "SEED_FROM" => { type: :string, description: "folder of existing clones (mounted into the container) laid out as `<owner>/<repo>` or `<owner>/<repo>.git`, new mirrors borrow objects from a matching clone so only the missing objects are downloaded from GitHub" },
+  "SERVE_HTTP_PORT" => { type: :integer, description: "port `ghbackup serve` serves read-only smart HTTP on, disabled when not set" },
+  "SERVE_PORT" => { type: :integer, default: "9418", description: "port `ghbackup serve` listens on" },
+  "SHRINK_PROTECTION" => { type: :boolean, description: "set to `true` to stop fetching a repository that has shrunk until the alert is acknowledged" },
+  "SHRINK_THRESHOLD" => { type: :number, default: "0", description: "percentage of branches and tags deleted, or commits made unreachable, between runs that raises a shrinkage alert" },
+  "SKIP_IDLE_MAX_AGE" => { type: :number, default: "24", description: "maximum number of hours between runs when `SKIP_IDLE_RUNS` is enabled" },
+  "SKIP_IDLE_RUNS" => { type: :boolean, description: "set to `true` to skip a run when the user's events show no activity since the previous run, activity in organizations by other users doesn't appear in these events so runs are never skipped for longer than `SKIP_IDLE_MAX_AGE`" },
+  "SMART_SCHEDULE" => { type: :boolean, description: "set to `true` to fetch repositories that rarely change less often" },
+  "SMART_SCHEDULE_MAX" => { type: :days, default: "7", description: "the most days (e.g. `7d`) a repository can go without being fetched under `SMART_SCHEDULE`" },
+  "SNAPSHOT_CMD" => { type: :string, description: "command to run after every fully successful run instead of `FS_SNAPSHOT`" },
+  "SOURCE_DIR" => { type: :string, description: "back up the git repositories in this directory instead of GitHub" },
+  "TENANTS_CONFIG" => { type: :string, description: "path to a JSON file describing multiple tenants to back up" },
+  "TENANT_WEIGHT" => { type: :integer, default: "1", description: "relative share of the workers given to a tenant when several are configured" },
+  "TOKEN_EXPIRY_WARNING_DAYS" => { type: :integer, default: "14", description: "warn in the run output, report and `ghbackup status` when the personal access token expires within this many days" },
+  "TOKEN_FILE" => { type: :string, default: "~/.config/ghbackup/token.enc", description: "where `ghbackup login` stores the encrypted token" },
+  "TOKEN_KEY_FILE" => { type: :string, default: "~/.config/ghbackup/token.key", description: "key used to encrypt the stored token, created on first login" },
+  "TOKEN_PROVIDER" => { type: :enum, values: %w[env file login vault aws gcp app], default: "env", description: "where to fetch the GitHub token from" },
+  "TOKEN_SECRET" => { type: :string, description: "path or name of the secret holding the token" },
+  "TOKEN_SECRET_KEY" => { type: :string, description: "field within the secret holding the token" },
+  "TRANSCRIPTS" => { type: :boolean, description: "set to `true` to write the git, age and snapshot commands a run executes to `.ghbackup/transcripts/<run>.sh`, with credentials redacted" },
+  "USER_AGENT_CONTACT" => { type: :string, default: "https://github.com/digitalpardoe/docker-ghbackup", description: "URL or email address included in the `User-Agent` sent to the GitHub API so the traffic can be attributed" },
+  "USER_AGENT_SUFFIX" => { type: :string, description: "text appended to the `User-Agent`, e.g. to identify the team or host running the backups" },
+  "VAULT_ADDR" => { type: :string, description: "address of the Vault server, e.g. `https://vault.example.com:8200`" },
+  "VAULT_ROLE_ID" => { type: :string, description: "AppRole role ID used to log in to Vault when `VAULT_TOKEN` isn't set" },
+  "VAULT_SECRET_ID" => { type: :string, description: "AppRole secret ID used to log in to Vault when `VAULT_TOKEN` isn't set" },
+  "VAULT_TOKEN" => { type: :string, description: "Vault token used to read the secret" },
+  "VERIFY_SAMPLE" => { type: :string, description: "number (e.g. `20`) or percentage (e.g. `10%`) of mirrors to check with `git fsck` after each run, the least recently verified mirrors are picked first so every mirror is verified within a bounded number of runs" },
+  "WORKERS" => { type: :integer, default: "1", description: "maximum number of repositories to back up in parallel, concurrency is halved when transfers fail or GitHub rate limits requests and gradually increased again once things are healthy" },
+  "WORK_DIR" => { type: :string, default: "/tmp/ghbackup", description: "scratch directory used for encrypted backups and restores" }
+}
+CONFIG_SETTINGS = CONFIG_SCHEMA.keys
+
+MINIMUM_GIT_VERSION = "1.8.5"
+# Settings that rely on features of newer versions of git, with the version
+# they need.
+GIT_FEATURES = {
+  seed_from: ["2.3.0", "SEED_FROM (git clone --dissociate)"]
+}
 
-if !lock_state
-  puts "Already running, exiting..."
-  exit
+class TokenProviderError < StandardError; end
+class PermissionError < StandardError; end
+class ConfigError < StandardError; end
+class LimitExceeded < StandardError; end
+class WorkspaceError < StandardError; end
+
+def canonical_env(env)
+  DEPRECATED_SETTINGS.each_with_object(env.to_h) do |(old, new), canonical|
+    value = canonical.delete(old)
+    canonical[new] = value if value && !value.empty? && canonical[new].to_s.empty?
+  end
 end
 
-begin
-  Octokit.configure do |c|
-    c.auto_paginate = true
+def load_config(env = ENV)
+  env = canonical_env(env)
+
+  {
+    github_secret: env["GITHUB_TOKEN"],
+    token_provider: env["TOKEN_PROVIDER"] || "env",
+    github_token_file: env["GITHUB_TOKEN_FILE"],
+    github_app_id: env["GITHUB_APP_ID"],
+    github_app_installation_id: env["GITHUB_APP_INSTALLATION_ID"],
+    github_app_private_key: env["GITHUB_APP_PRIVATE_KEY"],
+    token_secret: env["TOKEN_SECRET"],
+    token_secret_key: env["TOKEN_SECRET_KEY"],
+    github_client_id: env["GITHUB_CLIENT_ID"],
+    token_file: env["TOKEN_FILE"] || File.expand_path("~/.config/ghbackup/token.enc"),
+    token_key_file: env["TOKEN_KEY_FILE"] || File.expand_path("~/.config/ghbackup/token.key"),
+    vault_addr: env["VAULT_ADDR"],
+    vault_token: env["VAULT_TOKEN"],
+    vault_role_id: env["VAULT_ROLE_ID"],
+    vault_secret_id: env["VAULT_SECRET_ID"],
+    backup_folder: env["BACKUP_FOLDER"] || "/ghbackup",
+    work_dir: env["WORK_DIR"] || "/tmp/ghbackup",
+    age_recipients: (env["AGE_RECIPIENTS"] || "").split(/[\s,]+/).reject(&:empty?),
+    age_identity: env["AGE_IDENTITY"],
+    key_generation: (env["KEY_GENERATION"] || "1").to_i,
+    export_commit_statuses: env["EXPORT_COMMIT_STATUSES"] == "true",
+    commit_status_depth: (env["COMMIT_STATUS_DEPTH"] || "10").to_i,
+    export_deployments: env["EXPORT_DEPLOYMENTS"] == "true",
+    export_audit_log: env["EXPORT_AUDIT_LOG"] == "true",
+    export_account: env["EXPORT_ACCOUNT"] == "true",
+    export_org_integrations: env["EXPORT_ORG_INTEGRATIONS"] == "true",
+    export_settings: env["EXPORT_SETTINGS"] == "true",
+    backup_window: parse_window(env["BACKUP_WINDOW"]),
+    export_dir: env["EXPORT_DIR"],
+    serve_port: (env["SERVE_PORT"] || "9418").to_i,
+    serve_http_port: env["SERVE_HTTP_PORT"]&.to_i,
+    backup_interval: (env["BACKUP_INTERVAL"] || (env["MODE"] == "events" ? "24" : "0")).to_f,
+    repo_include: (env["REPO_INCLUDE"] || "").split(/[\s,]+/).reject(&:empty?),
+    repo_config: env["REPO_CONFIG"] ? JSON.parse(File.read(env["REPO_CONFIG"])) : {},
+    repo_exclude: (env["REPO_EXCLUDE"] || "").split(/[\s,]+/).reject(&:empty?),
+    tenant_weight: [(env["TENANT_WEIGHT"] || "1").to_i, 1].max,
+    verify_sample: env["VERIFY_SAMPLE"],
+    api_timeout: (env["API_TIMEOUT"] || "60").to_i,
+    api_open_timeout: (env["API_OPEN_TIMEOUT"] || "10").to_i,
+    run_tag: env["RUN_TAG"]&.gsub(/[^A-Za-z0-9._-]/, "-"),
+    prune_archive_days: (env["PRUNE_ARCHIVE_DAYS"] || "90").to_i,
+    token_expiry_warning_days: (env["TOKEN_EXPIRY_WARNING_DAYS"] || "14").to_i,
+    enterprise: env["ENTERPRISE"],
+    skip_idle_runs: env["SKIP_IDLE_RUNS"] == "true",
+    skip_idle_max_age: (env["SKIP_IDLE_MAX_AGE"] || "24").to_f,
+    mode: env["MODE"] || "scheduled",
+    events_interval: (env["EVENTS_INTERVAL"] || "60").to_i,
+    output: env["OUTPUT"] || "text",
+    seed_from: env["SEED_FROM"],
+    max_run_duration: (env["MAX_RUN_DURATION"] || "0").to_f,
+    max_api_calls: (env["MAX_API_CALLS"] || "0").to_i,
+    max_transfer_gb: (env["MAX_TRANSFER_GB"] || "0").to_f,
+    repo: env["REPO"],
+    command_logs: env["COMMAND_LOGS"] == "true",
+    transcripts: env["TRANSCRIPTS"] == "true",
+    max_total_size: parse_size(env["MAX_TOTAL_SIZE"]),
+    quota_eviction: env["QUOTA_EVICTION"] || "none",
+    prune_grace: (env["PRUNE_GRACE"] || "0").delete_suffix("d").to_f,
+    user_agent_contact: env["USER_AGENT_CONTACT"] || "https://github.com/digitalpardoe/docker-ghbackup",
+    user_agent_suffix: env["USER_AGENT_SUFFIX"],
+    shrink_threshold: (env["SHRINK_THRESHOLD"] || "0").to_f,
+    shrink_protection: env["SHRINK_PROTECTION"] == "true",
+    delayed_mirror: (env["DELAYED_MIRROR"] || "0").delete_suffix("d").to_f,
+    include_notes: env["INCLUDE_NOTES"] != "false",
+    deep_verify_interval: (env["DEEP_VERIFY_INTERVAL"] || "0").delete_suffix("d").to_f,
+    layout: env["LAYOUT"] || "flat",
+    name_normalization: env["NAME_NORMALIZATION"] || "none",
+    notify: (env["NOTIFY"] || "").split(/[\s,]+/).reject(&:empty?),
+    notify_on: env["NOTIFY_ON"] || "failures",
+    notify_templates: env["NOTIFY_TEMPLATES"],
+    notify_webhook_url: env["NOTIFY_WEBHOOK_URL"],
+    notify_command: env["NOTIFY_COMMAND"],
+    notifier_plugins: (env["NOTIFIER_PLUGINS"] || "").split(/[\s,]+/).reject(&:empty?),
+    linked_snapshots: (env["LINKED_SNAPSHOTS"] || "0").to_i,
+    canary_repo: env["CANARY_REPO"],
+    keep_previous: env["KEEP_PREVIOUS"] == "true",
+    search_index: env["SEARCH_INDEX"] == "true",
+    fs_snapshot: env["FS_SNAPSHOT"],
+    fs_snapshot_target: env["FS_SNAPSHOT_TARGET"],
+    fs_snapshot_keep: [(env["FS_SNAPSHOT_KEEP"] || "7").to_i, 1].max,
+    snapshot_cmd: env["SNAPSHOT_CMD"],
+    new_repositories: env["NEW_REPOSITORIES"] || "include",
+    check_github_status: env["CHECK_GITHUB_STATUS"] == "true",
+    github_status_max_delay: (env["GITHUB_STATUS_MAX_DELAY"] || "60").to_f,
+    smart_schedule: env["SMART_SCHEDULE"] == "true",
+    max_refs: (env["MAX_REFS"] || "0").to_i,
+    fetch_timeout: (env["FETCH_TIMEOUT"] || "0").to_f,
+    source_dir: env["SOURCE_DIR"],
+    smart_schedule_max: (env["SMART_SCHEDULE_MAX"] || "7").delete_suffix("d").to_f,
+    collector_budget: (env["COLLECTOR_BUDGET"] || "0").to_i,
+    list_backend: env["LIST_BACKEND"] || "rest",
+    healthcheck_max_age: (env["HEALTHCHECK_MAX_AGE"] || "12").to_f,
+    run_history: (env["RUN_HISTORY"] || "100").to_i,
+    run_history_days: (env["RUN_HISTORY_DAYS"] || "0").to_i,
+    activity_log: (env["ACTIVITY_LOG"] || "0").to_i,
+    read_only: env["READ_ONLY"] == "true",
+    host_name: env["HOST_NAME"] || Socket.gethostname,
+    host_status_dir: env["HOST_STATUS_DIR"],
+    host_status_url: env["HOST_STATUS_URL"],
+    host_status_token: env["HOST_STATUS_TOKEN"],
+    workers: [(env["WORKERS"] || "1").to_i, 1].max
+  }
+end
+
+# Adjusts how many repositories are backed up at once. Concurrency is halved
+# when GitHub throttles the workers, or after several transient failures in a
+# row, and raised again once things are healthy. Other failures, e.g. a
+# repository that's gone, and repositories skipped by limits don't count.
+class ConcurrencyController
+  TRANSIENT_FAILURES = 3
+
+  def initialize(limit)
+    @max = limit
+    @limit = limit
+    @active = 0
+    @healthy = 0
+    @transient = 0
+    @mutex = Mutex.new
+    @available = ConditionVariable.new
+  end
+
+  def acquire
+    @mutex.synchronize do
+      @available.wait(@mutex) while @active >= @limit
+      @active += 1
+    end
   end
 
-  github_secret = ENV["GITHUB_SECRET"]
-  backup_folder = ENV["BACKUP_FOLDER"] || "/ghbackup"
+  def release(outcome)
+    @mutex.synchronize do
+      @active -= 1
 
-  client = Octokit::Client.new(access_token: github_secret)
+      case outcome
+      when :success
+        @healthy += 1
+        @transient = 0
 
-  login = client.user[:login]
+        if @limit < @max && @healthy >= @limit * 2
+          @limit += 1
+          @healthy = 0
+          puts "Concurrency increased to #{@limit}"
+        end
+      when :throttled
+        reduce
+      when :transient
+        @healthy = 0
+        @transient += 1
+        reduce if @transient >= TRANSIENT_FAILURES
+      end
 
-  client.repos.each do |repo|
-    uri = URI.parse(repo[:clone_url])
-    authenitcated_clone_url = "#{uri.scheme}://#{login}:#{github_secret}@#{uri.host}#{uri.path}"
-    
-    backup_path = "#{backup_folder}/#{repo[:full_name]}.git"
+      @available.broadcast
+    end
+  end
 
-    p "Backing up #{repo[:full_name]}..."
+  private
 
-    if Dir.exist?(backup_path)
-      Dir.chdir(backup_path) {
-        system('git', 'remote', 'update')
-      }
+  def reduce
+    @healthy = 0
+    @transient = 0
+    return if @limit == 1
+
+    @limit = [@limit / 2, 1].max
+    puts "Concurrency reduced to #{@limit}"
+  end
+end
+
+def write_json(path, data)
+  FileUtils.mkdir_p(File.dirname(path))
+  File.write("#{path}.tmp", JSON.pretty_generate(data))
+  File.rename("#{path}.tmp", path)
+end
+
+class TenantScheduler
+  def initialize(tenants)
+    @tenants = tenants
+    @credit = Hash.new(0)
+    @mutex = Mutex.new
+  end
+
+  # Picks the next repository using smooth weighted round-robin across the
+  # tenants that have work left, are inside their backup window and haven't
+  # reached their own worker limit. Tenants past their MAX_RUN_DURATION
+  # deadline, or over their MAX_API_CALLS or MAX_TRANSFER_GB budget, have
+  # what's left of their queue moved to :skipped while the repositories in
+  # flight finish. Returns :wait when work remains but no tenant can start
+  # right now, and nil once every queue is empty.
+  def next_item
+    @mutex.synchronize do
+      @tenants.each do |tenant|
+        next if tenant[:queue].empty?
+
+        reason = stop_reason(tenant)
+        next if reason.nil?
+
+        tenant[:stopped] = reason
+        tenant[:skipped] = tenant[:queue].map { |repo| repo[:full_name] }
+        tenant[:queue].clear
+      end
+
+      pending = @tenants.select { |tenant| tenant[:queue].any? }
+      return nil if pending.empty?
+
+      ready = pending.select do |tenant|
+        tenant[:active] < tenant[:config][:workers] && within_window?(tenant[:config][:backup_window])
+      end
+      return :wait if ready.empty?
+
+      total = ready.sum { |tenant| tenant[:config][:tenant_weight] }
+      ready.each { |tenant| @credit[tenant[:name]] += tenant[:config][:tenant_weight] }
+
+      tenant = ready.max_by { |candidate| @credit[candidate[:name]] }
+      @credit[tenant[:name]] -= total
+      tenant[:active] += 1
+
+      [tenant, tenant[:queue].shift]
+    end
+  end
+
+  def finished(tenant)
+    @mutex.synchronize { tenant[:active] -= 1 }
+  end
+
+  private
+
+  def stop_reason(tenant)
+    config = tenant[:config]
+
+    if tenant[:deadline] && Time.now.utc >= tenant[:deadline]
+      "Stopped after #{config[:max_run_duration]} hours"
     else
-      system('git', 'clone', '--mirror', '--no-checkout', '--progress', authenitcated_clone_url, backup_path)
+      budget_exhausted(config, tenant[:run][:usage])
+    end
+  end
+end
+
+# Why a run with this usage shouldn't start any more repositories, or nil
+# while it's within MAX_API_CALLS and MAX_TRANSFER_GB.
+def budget_exhausted(config, usage)
+  if config[:max_api_calls] > 0 && usage.api_calls >= config[:max_api_calls]
+    "Stopped after #{usage.api_calls} API calls, MAX_API_CALLS is #{config[:max_api_calls]}"
+  elsif config[:max_transfer_gb] > 0 && usage.transferred >= config[:max_transfer_gb] * 1024**3
+    "Stopped after transferring #{human_size(usage.transferred)}, MAX_TRANSFER_GB is #{config[:max_transfer_gb]}"
+  end
+end
+
+# What a run has used of the MAX_API_CALLS and MAX_TRANSFER_GB budgets. API
+# calls are counted by the client middleware for the run set on the thread.
+class RunUsage
+  attr_reader :api_calls, :transferred
+
+  def initialize
+    @api_calls = 0
+    @transferred = 0
+    @mutex = Mutex.new
+  end
+
+  def api_call
+    @mutex.synchronize { @api_calls += 1 }
+  end
+
+  def transfer(bytes)
+    @mutex.synchronize { @transferred += bytes }
+  end
+
+  def to_h
+    @mutex.synchronize { { "api_calls" => @api_calls, "transferred" => @transferred } }
+  end
+end
+
+def manifest_path(backup_folder)
+  "#{backup_folder}/.ghbackup/manifest.json"
+end
+
+def load_manifest(backup_folder)
+  path = manifest_path(backup_folder)
+  File.exist?(path) ? JSON.parse(File.read(path)) : { "artifacts" => {} }
+end
+
+def save_manifest(backup_folder, manifest)
+  write_json(manifest_path(backup_folder), manifest)
+end
+
+def state_path(backup_folder)
+  "#{backup_folder}/.ghbackup/state.json"
+end
+
+def load_state(backup_folder)
+  path = state_path(backup_folder)
+  File.exist?(path) ? JSON.parse(File.read(path)) : {}
+end
+
+def save_state(backup_folder, state)
+  write_json(state_path(backup_folder), state)
+end
+
+def artifact_name(full_name, run_tag)
+  run_tag ? "#{full_name}.#{run_tag}.bundle.age" : "#{full_name}.bundle.age"
+end
+
+def artifact_key(full_name, run_tag)
+  run_tag ? "#{full_name}@#{run_tag}" : full_name
+end
+
+def record_artifact(manifest, key, artifact, key_generation, run_tag)
+  manifest["artifacts"][key] = (manifest["artifacts"][key] || {}).merge(
+    "path" => artifact,
+    "key_generation" => key_generation,
+    "run_tag" => run_tag,
+    "updated_at" => Time.now.utc.iso8601
+  )
+end
+
+def read_marker(path)
+  marker = "#{path}/ghbackup.json"
+  File.exist?(marker) ? JSON.parse(File.read(marker)) : {}
+end
+
+def write_marker(path, data)
+  File.write("#{path}/ghbackup.json", JSON.pretty_generate(read_marker(path).merge(data)))
+end
+
+# Collects the output of the commands run while backing up a repository. Only
+# the last lines are kept in memory so they can be attached to the report when
+# the backup fails, the full output is written to a file when one is given.
+class CommandLog
+  def initialize(path = nil, limit = 50)
+    @lines = []
+    @limit = limit
+
+    if path
+      FileUtils.mkdir_p(File.dirname(path))
+      @file = File.open(path, "w")
+    end
+  end
+
+  def <<(line)
+    line = line.gsub(%r{//[^/@\s]+@}, "//***@")
+    @file&.puts(line)
+    @lines << line
+    @lines.shift while @lines.size > @limit
+  end
+
+  def tail
+    @lines.dup
+  end
+
+  def close
+    @file&.close
+  end
+end
+
+# Records the commands a run executes, one line each, in
+# .ghbackup/transcripts/<run>.sh so what a run did can be reviewed after an
+# incident, or replayed by hand when debugging. Credentials in URLs are
+# written as ${GHBACKUP_CREDENTIALS}, so the script runs once that's
+# exported. The file is only created once there's a command to record.
+class Transcript
+  attr_reader :path
+
+  def initialize(path, started_at)
+    @path = path
+    @started_at = started_at
+    @mutex = Mutex.new
+  end
+
+  def record(command, repository = nil)
+    line = "#{transcribe(command)} # #{Time.now.utc.iso8601}#{" #{repository}" if repository}"
+
+    @mutex.synchronize do
+      next if @closed
+
+      @file ||= open_file
+      @file.puts(line)
+    end
+  end
+
+  def written?
+    @mutex.synchronize { !@file.nil? }
+  end
+
+  def close
+    @mutex.synchronize do
+      @closed = true
+      @file&.close
+    end
+  end
+
+  private
+
+  def open_file
+    FileUtils.mkdir_p(File.dirname(@path))
+    File.open(@path, "w").tap do |file|
+      file.sync = true
+      file.puts("#!/bin/sh", "# ghbackup run started #{@started_at.iso8601}")
+    end
+  end
+
+  def transcribe(command)
+    Shellwords.join(command.map(&:to_s)).gsub(%r{//[^/@\s]+@}, "//${GHBACKUP_CREDENTIALS}@")
+  end
+end
+
+# Runs a command like system, but when a CommandLog is set for the current
+# thread its output is also captured there, and when the thread works for a
+# run with a Transcript the command is recorded in it.
+def execute(*command)
+  transcript, repository = Thread.current[:transcript]
+  transcript&.record(command, repository)
+
+  log = Thread.current[:command_log]
+  return system(*command) if log.nil?
+
+  log << "$ #{command.join(" ")}"
+  timeout = Thread.current[:command_timeout]
+
+  Open3.popen2e(*command) do |_, output, wait|
+    timed_out = false
+    watchdog = timeout && Thread.new do
+      sleep timeout
+      timed_out = true
+      Process.kill("TERM", wait.pid)
+    rescue Errno::ESRCH
+    end
+
+    output.each_line do |line|
+      print line
+      log << line.split("\r").last.to_s.chomp
+    end
+
+    status = wait.value
+    watchdog&.kill
+    raise LimitExceeded, "git #{command[1] == '-C' ? command[3] : command[1]} took longer than #{(timeout / 60).round} minutes" if timed_out
+
+    log << "exited with #{status.exitstatus}" unless status.success?
+    status.success?
+  end
+end
+
+# Counts the refs a remote advertises, giving up as soon as there are more
+# than the limit so a repository with millions of refs doesn't have to be
+# listed in full.
+def remote_ref_count(url, limit)
+  count = 0
+
+  Open3.popen2('git', 'ls-remote', url, err: File::NULL) do |_, output, wait|
+    output.each_line do
+      count += 1
+      next if count <= limit
+
+      Process.kill("TERM", wait.pid)
+      break
+    end
+
+    wait.value
+  end
+
+  count
+end
+
+def configure_refspecs(path, refs)
+  execute('git', '-C', path, 'config', '--unset-all', 'remote.origin.fetch')
+  execute('git', '-C', path, 'config', '--unset', 'remote.origin.mirror')
+  refs.each { |ref| execute('git', '-C', path, 'config', '--add', 'remote.origin.fetch', "+#{ref}:#{ref}") }
+  execute('git', '-C', path, 'config', 'remote.origin.tagOpt', '--no-tags')
+
+  head = refs.find { |ref| ref.start_with?("refs/heads/") && !ref.include?("*") }
+  execute('git', '-C', path, 'symbolic-ref', 'HEAD', head) if head
+end
+
+def configure_full_mirror(path)
+  execute('git', '-C', path, 'config', '--replace-all', 'remote.origin.fetch', '+refs/*:refs/*')
+  execute('git', '-C', path, 'config', 'remote.origin.mirror', 'true')
+  execute('git', '-C', path, 'config', '--unset', 'remote.origin.tagOpt')
+end
+
+def seed_path(config, full_name)
+  seed_from = config[:seed_from]
+  return nil if seed_from.nil?
+
+  [full_name, stored_name(config, full_name)].uniq.flat_map { |name| ["#{seed_from}/#{name}.git", "#{seed_from}/#{name}"] }.find do |path|
+    File.directory?("#{path}/objects") || File.directory?("#{path}/.git/objects")
+  end
+end
+
+def clone_mirror(url, path, refs, seed = nil)
+  if refs.nil?
+    reference = seed ? ['--reference', seed, '--dissociate'] : []
+    return execute('git', 'clone', '--mirror', '--no-checkout', '--progress', *reference, url, path)
+  end
+
+  return false unless execute('git', 'init', '--quiet', '--bare', path)
+  return false unless execute('git', '-C', path, 'remote', 'add', 'origin', url)
+
+  configure_refspecs(path, refs)
+  return execute('git', '-C', path, 'fetch', '--prune', '--progress', 'origin') if seed.nil?
+
+  alternates = "#{path}/objects/info/alternates"
+  File.write(alternates, File.expand_path(File.directory?("#{seed}/objects") ? "#{seed}/objects" : "#{seed}/.git/objects") + "\n")
+
+  begin
+    execute('git', '-C', path, 'fetch', '--prune', '--progress', 'origin') && execute('git', '-C', path, 'repack', '-a', '-d', '-q')
+  ensure
+    FileUtils.rm_f(alternates)
+  end
+end
+
+def update_mirror(path, refs, url)
+  execute('git', '-C', path, 'remote', 'set-url', 'origin', url)
+
+  if refs
+    configure_refspecs(path, refs)
+    execute('git', '-C', path, 'fetch', '--prune', '--progress', 'origin')
+  else
+    configure_full_mirror(path) if read_marker(path)["partial"]
+    execute('git', '-C', path, 'remote', 'update')
+  end
+end
+
+# Points a mirror's HEAD at the default branch. A fetch never moves HEAD, so
+# when the default branch changes upstream the mirror keeps the old one, or a
+# dangling HEAD if that branch was deleted.
+def repair_head(path, full_name, branch)
+  return if branch.nil?
+
+  head, _ = Open3.capture2('git', '-C', path, 'symbolic-ref', '--quiet', 'HEAD', err: File::NULL)
+  return if head.strip == "refs/heads/#{branch}"
+  return unless system('git', '-C', path, 'show-ref', '--verify', '--quiet', "refs/heads/#{branch}")
+
+  puts "Pointing HEAD of #{full_name} at #{branch}#{" instead of #{head.strip.delete_prefix("refs/heads/")}" unless head.strip.empty?}"
+  execute('git', '-C', path, 'symbolic-ref', 'HEAD', "refs/heads/#{branch}")
+end
+
+def write_metadata(metadata_path, name, data)
+  FileUtils.mkdir_p(metadata_path)
+  File.write("#{metadata_path}/#{name}.json", JSON.pretty_generate(data))
+end
+
+def export_commit_statuses(client, repo, metadata_path, depth)
+  client.auto_paginate = false
+  commits = client.commits(repo[:full_name], repo[:default_branch], per_page: depth)
+
+  statuses = commits.map do |commit|
+    {
+      sha: commit[:sha],
+      combined_status: client.combined_status(repo[:full_name], commit[:sha]).to_attrs,
+      check_runs: client.check_runs_for_ref(repo[:full_name], commit[:sha], per_page: 100)[:check_runs].map(&:to_attrs)
+    }
+  end
+
+  write_metadata(metadata_path, "commit_statuses", statuses)
+ensure
+  client.auto_paginate = true
+end
+
+def export_deployments(client, repo, metadata_path)
+  deployments = client.deployments(repo[:full_name]).map do |deployment|
+    deployment.to_attrs.merge(statuses: client.deployment_statuses(deployment[:url]).map(&:to_attrs))
+  end
+
+  environments = client.environments(repo[:full_name])[:environments].map(&:to_attrs)
+
+  write_metadata(metadata_path, "deployments", { environments: environments, deployments: deployments })
+end
+
+def export_rulesets(client, full_name)
+  client.paginate("repos/#{full_name}/rulesets", includes_parents: true, per_page: 100).map do |ruleset|
+    client.get("repos/#{full_name}/rulesets/#{ruleset[:id]}", includes_parents: true).to_attrs
+  end
+end
+
+# Returns nil rather than failing the whole export for settings that aren't
+# available for a repository, e.g. when a feature isn't enabled for it.
+def optional_setting
+  yield
+rescue *RATE_LIMIT_ERRORS
+  raise
+rescue Octokit::NotFound, Octokit::Forbidden
+  nil
+end
+
+def export_codespaces(client, full_name)
+  {
+    devcontainers: optional_setting { client.get("repos/#{full_name}/codespaces/devcontainers", per_page: 100)[:devcontainers].map(&:to_attrs) },
+    machines: optional_setting { client.get("repos/#{full_name}/codespaces/machines")[:machines].map(&:to_attrs) }
+  }
+end
+
+def export_settings(client, repo, metadata_path)
+  settings = {
+    rulesets: optional_setting { export_rulesets(client, repo[:full_name]) },
+    codespaces: export_codespaces(client, repo[:full_name]),
+    pages: optional_setting { client.get("repos/#{repo[:full_name]}/pages").to_attrs },
+    autolinks: optional_setting { client.get("repos/#{repo[:full_name]}/autolinks").map(&:to_attrs) },
+    custom_properties: optional_setting { client.get("repos/#{repo[:full_name]}/properties/values").map(&:to_attrs) }
+  }
+
+  write_metadata(metadata_path, "settings", settings)
+end
+
+def restore_rulesets(client, target, rulesets)
+  rulesets.each do |ruleset|
+    if ruleset["source_type"] != "Repository"
+      puts "Skipping ruleset #{ruleset["name"]}, it's defined by #{ruleset["source"]}"
+      next
+    end
+
+    client.post("repos/#{target}/rulesets", ruleset.slice("name", "target", "enforcement", "bypass_actors", "conditions", "rules"))
+    puts "Restored ruleset #{ruleset["name"]}"
+  end
+end
+
+def restore_pages(client, target, pages)
+  return if pages.nil?
+
+  source = pages["source"] && pages["source"].slice("branch", "path")
+  configuration = { "build_type" => pages["build_type"], "source" => source }.compact
+
+  begin
+    client.get("repos/#{target}/pages")
+  rescue Octokit::NotFound
+    client.post("repos/#{target}/pages", configuration)
+  end
+
+  client.put("repos/#{target}/pages", configuration.merge("cname" => pages["cname"], "https_enforced" => pages["https_enforced"]).compact)
+  puts "Restored GitHub Pages#{" for #{pages["cname"]}" if pages["cname"]}"
+end
+
+def restore_autolinks(client, target, autolinks)
+  return if autolinks.nil?
+
+  existing = client.get("repos/#{target}/autolinks").map { |autolink| autolink[:key_prefix] }
+
+  autolinks.each do |autolink|
+    next if existing.include?(autolink["key_prefix"])
+
+    client.post("repos/#{target}/autolinks", autolink.slice("key_prefix", "url_template", "is_alphanumeric"))
+    puts "Restored autolink #{autolink["key_prefix"]}"
+  end
+end
+
+def restore_custom_properties(client, target, properties)
+  return if properties.nil? || properties.empty?
+
+  client.patch("repos/#{target}/properties/values", properties: properties.map { |property| property.slice("property_name", "value") })
+  puts "Restored #{properties.size} custom properties"
+end
+
+def restore_settings(full_name, target)
+  abort "Usage: ghbackup restore-settings <owner>/<repo> [<target owner>/<repo>]" if full_name.nil?
+
+  config = resolve_token(load_config)
+  client = build_client(config)
+  target ||= full_name
+
+  path = "#{metadata_folder(config, full_name)}/settings.json"
+  abort "No settings exported for #{full_name}" unless File.exist?(path)
+
+  settings = JSON.parse(File.read(path))
+
+  restore_rulesets(client, target, settings["rulesets"] || [])
+  restore_pages(client, target, settings["pages"])
+  restore_autolinks(client, target, settings["autolinks"])
+  restore_custom_properties(client, target, settings["custom_properties"])
+rescue Octokit::Error, Faraday::Error, TokenProviderError => e
+  abort "Unable to restore settings to #{target}: #{e.message}"
+end
+
+# Shares out the API requests the metadata collectors may make in a run, so
+# they can't use up the rate limit needed for listing and cloning. Each
+# enabled collector gets an equal share of COLLECTOR_BUDGET percent of the
+# requests remaining when the run starts.
+class CollectorBudget
+  def initialize(total, collectors)
+    @allowance = collectors.map { |collector| [collector, total / [collectors.size, 1].max] }.to_h
+    @used = Hash.new(0)
+    @mutex = Mutex.new
+  end
+
+  def available?(collector)
+    @mutex.synchronize { @used[collector] < @allowance[collector] }
+  end
+
+  def spend(collector)
+    @mutex.synchronize { @used[collector] += 1 }
+  end
+
+  def usage
+    @mutex.synchronize do
+      @allowance.map { |collector, allowance| [collector, { "allowance" => allowance, "used" => @used[collector] }] }.to_h
     end
   end
+end
+
+# Counts the API requests made while a collector runs against its budget, and
+# every request against the run's usage.
+class RequestCounter < Faraday::Middleware
+  def call(env)
+    budget, collector = Thread.current[:collector]
+    budget&.spend(collector)
+    Thread.current[:usage]&.api_call
+    @app.call(env)
+  end
+end
+
+CLIENT_MIDDLEWARE = Octokit::Default::MIDDLEWARE.dup.tap { |stack| stack.insert(0, RequestCounter) }
+
+# Metadata collectors, in priority order. Each is enabled by its flag in the
+# configuration and called with the client, the repository, its metadata path
+# and the configuration. Adding a new kind of metadata only needs an exporter
+# registered here.
+Collector = Struct.new(:name, :flag, :export)
+COLLECTORS = []
+
+def register_collector(name, flag, &export)
+  COLLECTORS << Collector.new(name, flag, export)
+end
+
+register_collector("commit_statuses", :export_commit_statuses) do |client, repo, metadata_path, config|
+  export_commit_statuses(client, repo, metadata_path, config[:commit_status_depth])
+end
+
+register_collector("deployments", :export_deployments) do |client, repo, metadata_path, _|
+  export_deployments(client, repo, metadata_path)
+end
+
+register_collector("settings", :export_settings) do |client, repo, metadata_path, _|
+  export_settings(client, repo, metadata_path)
+end
+
+# Exports of the user's own account, written to _account/<name>.json once per
+# run so the account can be set up again from the backup.
+ACCOUNT_EXPORTS = {}
+
+def register_account_export(name, &export)
+  ACCOUNT_EXPORTS[name] = export
+end
+
+register_account_export("profile") { |client, login| client.user(login).to_attrs }
+register_account_export("ssh_keys") { |client, _| client.keys.map(&:to_attrs) }
+register_account_export("ssh_signing_keys") { |client, _| client.paginate("user/ssh_signing_keys").map(&:to_attrs) }
+register_account_export("gpg_keys") { |client, _| client.paginate("user/gpg_keys").map(&:to_attrs) }
+register_account_export("emails") { |client, _| client.emails.map(&:to_attrs) }
+register_account_export("followers") { |client, login| client.followers(login).map { |user| user[:login] } }
+register_account_export("following") { |client, login| client.following(login).map { |user| user[:login] } }
+register_account_export("organizations") { |client, _| client.organization_memberships.map(&:to_attrs) }
+register_account_export("teams") { |client, _| client.user_teams.map(&:to_attrs) }
+
+def export_account(config, client, login)
+  ACCOUNT_EXPORTS.each do |name, export|
+    write_json("#{config[:backup_folder]}/_account/#{name}.json", export.call(client, login))
+  rescue *RATE_LIMIT_ERRORS
+    raise
+  rescue Octokit::Error, Faraday::Error => e
+    annotate(config, "warning", "Unable to export the account's #{name.tr("_", " ")}: #{e.message}")
+  end
+
+  puts "Exported the account of #{login}"
+end
+
+def enabled_collectors(config)
+  return [] if config[:source_dir]
+
+  COLLECTORS.select { |collector| config[collector.flag] }
+end
+
+def run_collector(config, run, client, repo, collector, metadata_path)
+  started = Process.clock_gettime(Process::CLOCK_MONOTONIC)
+  result = :failed
+
+  result = with_budget(run, collector.name, repo[:full_name]) do
+    collector.export.call(client, repo, metadata_path, config)
+    :exported
+  end
+rescue *RATE_LIMIT_ERRORS
+  raise
+rescue Octokit::Error, Faraday::Error, SystemCallError => e
+  puts "Unable to export #{collector.name.tr("_", " ")} for #{repo[:full_name]}: #{e.message}"
+ensure
+  run[:mutex].synchronize do
+    stats = run[:collectors][collector.name] ||= { "exported" => 0, "failed" => [], "duration" => 0 }
+    stats["exported"] += 1 if result == :exported
+    stats["failed"] << repo[:full_name] if result == :failed
+    stats["duration"] += Process.clock_gettime(Process::CLOCK_MONOTONIC) - started
+  end
+end
+
+def collector_report(run)
+  usage = run[:budget]&.usage || {}
+
+  run[:collectors].map do |name, stats|
+    [name, stats.merge(
+      "duration" => stats["duration"].round(2),
+      "deferred" => (run[:deferred][name] || []).size,
+      "budget" => usage[name]
+    ).compact]
+  end.to_h
+end
+
+# Runs a collector within its budget. Once the budget is used up the collector
+# is deferred for the rest of the run and the repositories it missed go ahead
+# of the budget in the next run, so every repository is eventually covered.
+def with_budget(run, collector, full_name)
+  budget = run[:budget]
+  return yield if budget.nil?
+
+  overdue = (run[:state].dig("deferred_collectors", collector) || []).include?(full_name)
+
+  if !overdue && !budget.available?(collector)
+    run[:mutex].synchronize { (run[:deferred][collector] ||= []) << full_name }
+    return :deferred
+  end
+
+  Thread.current[:collector] = [budget, collector]
+  yield
 ensure
-  lock_file.close
-end
\ No newline at end of file
+  Thread.current[:collector] = nil
+end
+
+def export_packs(backup_path, export_dir)
+  execute('git', '-C', backup_path, 'repack', '-q')
+
+  packs = Dir.glob("#{backup_path}/objects/pack/pack-*.pack").sort.map do |pack|
+    hash = File.basename(pack, ".pack").delete_prefix("pack-")
+
+    %w[pack idx].each do |extension|
+      target = "#{export_dir}/packs/#{hash}.#{extension}"
+      next if File.exist?(target)
+
+      FileUtils.mkdir_p(File.dirname(target))
+      FileUtils.cp("#{backup_path}/objects/pack/pack-#{hash}.#{extension}", "#{target}.tmp")
+      File.rename("#{target}.tmp", target)
+    end
+
+    hash
+  end
+
+  refs, _ = Open3.capture2('git', '-C', backup_path, 'for-each-ref', '--format=%(objectname) %(refname)')
+
+  {
+    packs: packs,
+    refs: refs.lines.map { |line| line.chomp.split(" ", 2).reverse }.to_h
+  }
+end
+
+def write_export_manifest(export_dir, started_at, run_tag, exports)
+  name = [started_at.strftime("%Y%m%dT%H%M%SZ"), run_tag].compact.join("-")
+  path = "#{export_dir}/runs/#{name}.json"
+  FileUtils.mkdir_p(File.dirname(path))
+  File.write(path, JSON.pretty_generate(exports))
+end
+
+def recipient_args(recipients)
+  recipients.flat_map { |recipient| ['-r', recipient] }
+end
+
+# Scratch space for encrypted backups, restores and migrations. Each process
+# works in its own directory below WORK_DIR which is removed when it exits,
+# successfully or not, and directories left behind by processes that are no
+# longer running, e.g. after the container was killed, are removed by the next
+# backup.
+def workspace(config)
+  path = "#{config[:work_dir]}/#{Process.pid}"
+
+  unless Dir.exist?(path)
+    FileUtils.mkdir_p(path)
+    at_exit { FileUtils.rm_rf(path) }
+  end
+
+  path
+end
+
+# Workspaces of processes that are no longer running, plus bundles left over
+# from before each process had its own workspace, when they were put straight
+# into WORK_DIR. Nothing else in WORK_DIR is touched in case it's shared with
+# other programs.
+def stale_workspaces(config)
+  workspaces = Dir.glob("#{config[:work_dir]}/*").select do |path|
+    pid = File.basename(path)
+    next false unless pid.match?(/\A\d+\z/) && File.directory?(path)
+
+    Process.kill(0, pid.to_i)
+    false
+  rescue Errno::ESRCH
+    true
+  rescue Errno::EPERM
+    false
+  end
+
+  workspaces + Dir.glob(%w[*/*.restore.bundle */*.migrate.bundle].map { |pattern| "#{config[:work_dir]}/#{pattern}" })
+end
+
+# Encrypted backups clone each repository and bundle it in the workspace, so
+# it needs room for about twice the size of the largest repository. Runs that
+# couldn't finish are refused up front rather than failing part way through.
+def check_workspace(config, queue)
+  return if config[:age_recipients].empty? || queue.empty?
+
+  needed = queue.map { |repo| repo[:size].to_i * 1024 * 2 }.max
+  available = disk_stats(config[:work_dir])&.fetch("available")
+  return if available.nil? || available >= needed
+
+  largest = queue.max_by { |repo| repo[:size].to_i }
+  raise WorkspaceError, "WORK_DIR #{config[:work_dir]} has #{human_size(available)} free but #{largest[:full_name]} needs about #{human_size(needed)}"
+end
+
+def backup_encrypted(clone_url, full_name, artifact_path, work_dir, recipients, refs, seed)
+  work_path = "#{work_dir}/#{full_name}.git"
+  bundle_path = "#{work_path}.bundle"
+
+  FileUtils.rm_rf(work_path)
+  FileUtils.mkdir_p(File.dirname(artifact_path))
+
+  return false unless clone_mirror(clone_url, work_path, refs, seed)
+
+  yield work_path if block_given?
+
+  return false unless execute('git', '-C', work_path, 'bundle', 'create', bundle_path, '--all')
+  return false unless execute('age', *recipient_args(recipients), '-o', "#{artifact_path}.tmp", bundle_path)
+
+  File.rename("#{artifact_path}.tmp", artifact_path)
+  true
+ensure
+  FileUtils.rm_rf(work_path)
+  FileUtils.rm_f(bundle_path)
+end
+
+def restore(full_name, destination)
+  if full_name.nil? || destination.nil?
+    abort "Usage: ghbackup restore <owner>/<repo> <destination>"
+  end
+
+  config = load_config
+  artifact = load_manifest(config[:backup_folder])["artifacts"][artifact_key(full_name, config[:run_tag])] || {}
+
+  artifact_path = "#{config[:backup_folder]}/#{artifact["path"] || artifact_name(stored_name(config, full_name), config[:run_tag])}"
+  bundle_path = "#{workspace(config)}/#{full_name}.restore.bundle"
+
+  abort "No encrypted backup found for #{full_name}" unless File.exist?(artifact_path)
+  abort "AGE_IDENTITY is required to restore #{full_name}, its backup is encrypted" if config[:age_identity].nil?
+
+  refs = artifact["refs"]
+  puts "#{full_name} is a partial backup containing only #{refs.join(", ")}" if refs
+
+  FileUtils.mkdir_p(File.dirname(bundle_path))
+
+  system('age', '-d', '-i', config[:age_identity], '-o', bundle_path, artifact_path) &&
+    system('git', 'clone', '--mirror', bundle_path, destination)
+ensure
+  FileUtils.rm_f(bundle_path) if bundle_path
+end
+
+# Clones a mirror into a normal working tree at the given ref. LFS objects in
+# the mirror are copied into the clone first so they're checked out from the
+# backup rather than downloaded.
+def checkout(full_name, destination, ref)
+  if full_name.nil? || destination.nil?
+    abort "Usage: ghbackup checkout <owner>/<repo> <destination> [--ref <ref>]"
+  end
+
+  config = load_config
+  path = mirror_path(config, full_name)
+
+  abort "No mirror found for #{full_name}#{", use ghbackup restore for encrypted backups" if config[:age_recipients].any?}" unless Dir.exist?(path)
+  abort "#{destination} already exists" if File.exist?(destination)
+
+  system('git', 'clone', '--no-checkout', '--quiet', path, destination) || abort("Unable to clone #{full_name}")
+
+  if Dir.exist?("#{path}/lfs/objects")
+    puts "Warning: #{full_name} has LFS objects but git-lfs isn't installed, they'll be checked out as pointers" unless git_lfs_version
+    FileUtils.mkdir_p("#{destination}/.git/lfs")
+    FileUtils.cp_r("#{path}/lfs/objects", "#{destination}/.git/lfs/objects")
+  end
+
+  system({ "GIT_LFS_SKIP_SMUDGE" => nil }, 'git', '-C', destination, 'checkout', '--quiet', '-f', *ref) || abort("Unable to check out #{ref || "the default branch"} of #{full_name}")
+  puts "Checked out #{full_name}#{" at #{ref}" if ref} to #{destination}"
+end
+
+LFS_POINTER = %r{\Aversion https://git-lfs\.github\.com/spec/v1\n}
+
+# Writes a single file from a mirror to stdout. LFS pointers are replaced with
+# the object they point to when the mirror holds it.
+def cat(full_name, ref, file)
+  abort "Usage: ghbackup cat <owner>/<repo> <ref> <path>" if full_name.nil? || ref.nil? || file.nil?
+
+  path = mirror_path(load_config, full_name)
+  abort "No mirror found for #{full_name}" unless Dir.exist?(path)
+
+  content, status = Open3.capture2('git', '-C', path, 'cat-file', 'blob', "#{ref}:#{file}", binmode: true)
+  abort "#{file} doesn't exist at #{ref} in #{full_name}" unless status.success?
+
+  if content.match?(LFS_POINTER)
+    oid = content[/^oid sha256:(\h{64})$/, 1]
+    object = oid && "#{path}/lfs/objects/#{oid[0, 2]}/#{oid[2, 2]}/#{oid}"
+
+    if object && File.exist?(object)
+      content = File.binread(object)
+    else
+      $stderr.puts "#{file} is an LFS pointer and the mirror doesn't hold its object, writing the pointer"
+    end
+  end
+
+  $stdout.binmode
+  $stdout.write(content)
+end
+
+def rekey
+  config = load_config
+  backup_folder = config[:backup_folder]
+  identity = config[:age_identity]
+  age_recipients = config[:age_recipients]
+  key_generation = config[:key_generation]
+
+  abort "AGE_IDENTITY and AGE_RECIPIENTS are required to rekey" if identity.nil? || age_recipients.empty?
+
+  with_lock do
+    manifest = load_manifest(backup_folder)
+
+    manifest["artifacts"].each do |full_name, artifact|
+      next if artifact["key_generation"] == key_generation
+
+      artifact_path = "#{backup_folder}/#{artifact["path"]}"
+
+      puts "Rekeying #{full_name} from generation #{artifact["key_generation"]} to #{key_generation}..."
+
+      statuses = Open3.pipeline(
+        ['age', '-d', '-i', identity, artifact_path],
+        ['age', *recipient_args(age_recipients), '-o', "#{artifact_path}.tmp"]
+      )
+
+      if statuses.all?(&:success?)
+        File.rename("#{artifact_path}.tmp", artifact_path)
+        record_artifact(manifest, full_name, artifact["path"], key_generation, artifact["run_tag"])
+        manifest["artifacts"][full_name]["sha256"] = Digest::SHA256.file(artifact_path).hexdigest
+        save_manifest(backup_folder, manifest)
+      else
+        FileUtils.rm_f("#{artifact_path}.tmp")
+        puts "Unable to rekey #{full_name}"
+      end
+    end
+  end
+end
+
+# Mirrors live at <owner>/<repo>.git, or <shard>/<owner>/<repo>.git with
+# LAYOUT=sharded where the shard is the first two characters of the owner so
+# no single directory ends up with thousands of entries.
+def mirror_path(config, full_name)
+  shard = "#{full_name.split("/").first[0, 2].downcase}/" if config[:layout] == "sharded"
+  "#{config[:backup_folder]}/#{shard}#{stored_name(config, full_name)}.git"
+end
+
+# Names as they're stored in the backup folder. Some filesystems (e.g. SMB
+# shares and exFAT) are case-insensitive or mangle names with dots in them, so
+# NAME_NORMALIZATION can lowercase names and percent-encode the dots as well.
+# The original name is recorded in the mirror's marker file.
+def stored_name(config, full_name)
+  case config[:name_normalization]
+  when "lowercase" then full_name.downcase
+  when "encode" then full_name.downcase.gsub(".", "%2E")
+  else full_name
+  end
+end
+
+def metadata_folder(config, full_name)
+  "#{config[:backup_folder]}/_metadata/#{stored_name(config, full_name)}"
+end
+
+# The repositories with exported metadata, as [full name, path] pairs. Names
+# are matched to the listed repositories as they're stored, as the original
+# names aren't recorded alongside the metadata.
+def metadata_folders(config, listed)
+  names = listed.map { |full_name| [stored_name(config, full_name), full_name] }.to_h
+
+  Dir.glob("#{config[:backup_folder]}/_metadata/*/*").sort.map do |path|
+    name = path.delete_prefix("#{config[:backup_folder]}/_metadata/")
+    [names[name] || name.gsub("%2E", "."), path]
+  end
+end
+
+def mirror_paths(backup_folder)
+  Dir.glob(["#{backup_folder}/*/*.git", "#{backup_folder}/*/*/*.git"]).reject { |path| path.delete_prefix("#{backup_folder}/").start_with?("_") }.sort.map do |path|
+    marker = read_marker(path)
+    name = marker["normalized"] && marker["normalized"] != "none" ? marker["full_name"] : nil
+
+    [name || path.split("/").last(2).join("/").delete_suffix(".git").gsub("%2E", "."), path]
+  end
+end
+
+# Indexes the words (of at least three characters) in the text files on the
+# default branch of a mirror, lowercased and mapped to the files they're in.
+# The index is only rebuilt when HEAD has moved since it was last built.
+def update_search_index(path)
+  commit, _ = Open3.capture2('git', '-C', path, 'rev-parse', '--verify', '--quiet', 'HEAD^{commit}')
+  return if commit.strip.empty?
+
+  index_path = "#{path}/ghbackup-index.json"
+  return if File.exist?(index_path) && JSON.parse(File.read(index_path))["commit"] == commit.strip
+
+  files = {}
+  tokens = Hash.new { |hash, token| hash[token] = [] }
+
+  Open3.popen2('git', '-C', path, 'grep', '-I', '-z', '-o', '-E', '-e', '[[:alnum:]_]{3,}', 'HEAD') do |_, output, wait|
+    output.each_line do |line|
+      file, token = line.chomp.delete_prefix("HEAD:").split("\0", 2)
+      next if token.nil?
+
+      id = files[file] ||= files.size
+      postings = tokens[token.downcase]
+      postings << id unless postings.last == id
+    end
+
+    wait.value
+  end
+
+  File.write(index_path, JSON.generate("commit" => commit.strip, "files" => files.keys, "tokens" => tokens))
+end
+
+# The files on the default branch of a mirror that can match the query, or nil
+# when every file has to be searched because there's no up to date index or
+# the query isn't made up of plain words.
+def search_candidates(path, query)
+  index_path = "#{path}/ghbackup-index.json"
+  words = query.downcase.scan(/\w{3,}/)
+  return nil if words.empty? || !query.match?(%r{\A[\w\s.\-/]+\z}) || !File.exist?(index_path)
+
+  index = JSON.parse(File.read(index_path))
+  commit, _ = Open3.capture2('git', '-C', path, 'rev-parse', '--verify', '--quiet', 'HEAD^{commit}')
+  return nil unless index["commit"] == commit.strip
+
+  # Words at either end of the query can be part of a longer word in a file,
+  # so any indexed word containing them counts.
+  ids = words.map do |word|
+    index["tokens"].select { |token, _| token.include?(word) }.values.flatten.uniq
+  end.reduce(:&)
+
+  ids.map { |id| index["files"][id] }
+end
+
+def search(query)
+  abort "Usage: ghbackup search <query>" if query.nil?
+
+  config = load_config
+
+  mirror_paths(config[:backup_folder]).each do |full_name, path|
+    candidates = search_candidates(path, query)
+    pathspecs = candidates ? candidates.map { |file| ":(literal)#{file}" }.each_slice(500).to_a : [[]]
+
+    pathspecs.each do |slice|
+      output, _, _ = Open3.capture3('git', '-C', path, 'grep', '-I', '-n', '-i', '-e', query, 'HEAD', '--', *slice)
+
+      output.each_line do |line|
+        puts "#{full_name}:#{line.delete_prefix("HEAD:")}"
+      end
+    end
+  end
+end
+
+def http_backend(config, request, response)
+  path = request.path.delete_prefix("/git")
+  shard = %r{[^/]+/} if config[:layout] == "sharded"
+  path = path.sub(%r{\A/(#{shard})([^/]+)/([^/]+)\.git(?=/)}) { "/#{$1}#{stored_name(config, "#{$2}/#{$3}")}.git" }
+
+  if path.end_with?("/git-receive-pack") || request.query_string.to_s.include?("git-receive-pack")
+    response.status = 403
+    response.body = "Backups are read-only\n"
+    return
+  end
+
+  env = {
+    "GIT_PROJECT_ROOT" => config[:backup_folder],
+    "PATH_INFO" => path,
+    "QUERY_STRING" => request.query_string.to_s,
+    "REQUEST_METHOD" => request.request_method,
+    "CONTENT_TYPE" => request.content_type.to_s,
+    "HTTP_CONTENT_ENCODING" => request["Content-Encoding"].to_s,
+    "GIT_PROTOCOL" => git_at_least?("2.18.0") ? request["Git-Protocol"].to_s : ""
+  }
+
+  stdin, stdout, _ = Open3.popen2(env, 'git', 'http-backend')
+  stdin.binmode
+  stdout.binmode
+  stdin.write(request.body.to_s)
+  stdin.close
+
+  while (line = stdout.gets) && !line.strip.empty?
+    name, value = line.strip.split(": ", 2)
+
+    if name.casecmp?("Status")
+      response.status = value.to_i
+    else
+      response[name] = value
+    end
+  end
+
+  response.body = stdout
+end
+
+def sd_notify(message)
+  path = ENV["NOTIFY_SOCKET"]
+  return if path.nil? || path.empty?
+
+  socket = Socket.new(:UNIX, :DGRAM)
+  socket.connect(Socket.sockaddr_un(path.sub(/\A@/, "\0")))
+  socket.write(message)
+ensure
+  socket.close if socket
+end
+
+def start_watchdog
+  interval = ENV["WATCHDOG_USEC"].to_i / 2_000_000.0
+  return if interval <= 0
+
+  Thread.new do
+    loop do
+      sd_notify("WATCHDOG=1")
+      sleep interval
+    end
+  end
+end
+
+def serve
+  config = load_config
+  server = nil
+
+  daemon = spawn('git', 'daemon', '--reuseaddr', "--base-path=#{config[:backup_folder]}", "--port=#{config[:serve_port]}", config[:backup_folder])
+
+  %w[INT TERM].each do |signal|
+    trap(signal) do
+      server.shutdown if server
+      Process.kill("TERM", daemon)
+    rescue Errno::ESRCH
+    end
+  end
+
+  start_watchdog
+
+  if config[:serve_http_port]
+    require 'webrick'
+
+    server = WEBrick::HTTPServer.new(Port: config[:serve_http_port], AccessLog: [], StartCallback: -> { sd_notify("READY=1") })
+    server.mount_proc("/git") { |request, response| http_backend(config, request, response) }
+    server.mount_proc("/api/runs") do |_, response|
+      runs = load_tenants.map { |name, tenant_config| [name, load_state(tenant_config[:backup_folder])["runs"] || []] }.to_h
+
+      response["Content-Type"] = "application/json"
+      response.body = JSON.generate(runs)
+    end
+    server.mount_proc("/api/hosts") do |request, response|
+      if config[:host_status_dir].nil?
+        response.status = 404
+        response.body = "HOST_STATUS_DIR isn't set\n"
+      elsif request.request_method == "POST" && !host_status_authorized?(config, request["Authorization"])
+        response.status = 403
+        response.body = "Posting a host status needs HOST_STATUS_TOKEN\n"
+      elsif request.request_method == "POST"
+        status = JSON.parse(request.body.to_s)
+
+        if status["host"].to_s.match?(/\A[\w.-]+\z/)
+          write_json("#{config[:host_status_dir]}/#{status["host"]}.json", status)
+          response.status = 204
+        else
+          response.status = 400
+          response.body = "Invalid host\n"
+        end
+      else
+        response["Content-Type"] = "application/json"
+        response.body = JSON.generate(Dir.glob("#{config[:host_status_dir]}/*.json").sort.map { |path| JSON.parse(File.read(path)) })
+      end
+    rescue JSON::ParserError => e
+      response.status = 400
+      response.body = "#{e.message}\n"
+    end
+    server.mount_proc("/api/config-schema") do |_, response|
+      response["Content-Type"] = "application/json"
+      response.body = JSON.generate(config_schema)
+    end
+    server.start
+  else
+    sd_notify("READY=1")
+  end
+
+  Process.wait(daemon)
+end
+
+def parse_window(window)
+  return nil if window.nil? || window.empty?
+
+  window.split("-").map do |time|
+    hours, minutes = time.split(":").map(&:to_i)
+    hours * 60 + minutes
+  end
+end
+
+def within_window?(window, time = Time.now)
+  return true if window.nil?
+
+  start, finish = window
+  minute = time.hour * 60 + time.min
+
+  if start <= finish
+    minute >= start && minute < finish
+  else
+    minute >= start || minute < finish
+  end
+end
+
+def ensure_home
+  return if ENV["HOME"] && File.writable?(ENV["HOME"])
+
+  ENV["HOME"] = "/tmp/ghbackup-home-#{Process.uid}"
+  FileUtils.mkdir_p(ENV["HOME"])
+end
+
+LFS_FILTER = <<~CONFIG
+  [filter "lfs"]
+  \tclean = git-lfs clean -- %f
+  \tsmudge = git-lfs smudge -- %f
+  \tprocess = git-lfs filter-process
+  \trequired = true
+CONFIG
+
+# git-lfs relies on filters in the global git configuration, which in a
+# container is often missing or shared with other tools, and running git lfs
+# install from parallel workers races on the config lock. ghbackup writes its
+# own global configuration once at startup, including the user's ~/.gitconfig,
+# and points every git command at it. Clones and fetches never download LFS
+# files, only ghbackup checkout turns pointers into files.
+def configure_git
+  path = "/tmp/ghbackup-git-#{Process.uid}/git/config"
+  user_config = File.expand_path("~/.gitconfig")
+  use_global = git_at_least?("2.32.0")
+
+  content = LFS_FILTER.dup
+  content << "[include]\n\tpath = #{user_config}\n" if use_global && File.exist?(user_config)
+
+  unless File.exist?(path) && File.read(path) == content
+    FileUtils.mkdir_p(File.dirname(path))
+    File.write("#{path}.#{Process.pid}", content)
+    File.rename("#{path}.#{Process.pid}", path)
+  end
+
+  # Older versions of git don't support GIT_CONFIG_GLOBAL but read
+  # $XDG_CONFIG_HOME/git/config alongside ~/.gitconfig.
+  if use_global
+    ENV["GIT_CONFIG_GLOBAL"] = path
+  else
+    ENV["XDG_CONFIG_HOME"] = File.dirname(File.dirname(path))
+  end
+
+  ENV["GIT_LFS_SKIP_SMUDGE"] = "1"
+end
+
+def lfs_warnings
+  return [] if git_lfs_version.nil?
+
+  process, _ = Open3.capture2('git', 'config', '--get', 'filter.lfs.process', err: File::NULL)
+  return [] if process.strip == "git-lfs filter-process"
+
+  ["git-lfs is installed but its filters are overridden in the git configuration (filter.lfs.process is #{process.strip.empty? ? "not set" : process.strip}), LFS files will be checked out as pointers"]
+end
+
+def check_permissions(config)
+  [config[:backup_folder], "#{config[:backup_folder]}/.ghbackup", config[:work_dir]].each do |path|
+    begin
+      FileUtils.mkdir_p(path)
+    rescue Errno::EACCES
+    end
+
+    next if File.writable?(path)
+
+    owner = File.exist?(path) ? "#{File.stat(path).uid}:#{File.stat(path).gid}" : "unknown"
+
+    raise PermissionError, "#{path} (owned by #{owner}) is not writable by #{Process.uid}:#{Process.gid}, " \
+      "either chown it to #{Process.uid}:#{Process.gid} or set PUID and PGID to match its owner"
+  end
+end
+
+def with_lock(wait: false)
+  lock_file = File.open("/tmp/ghbackup.lock", File::CREAT)
+  lock_state = lock_file.flock(wait ? File::LOCK_EX : File::LOCK_EX|File::LOCK_NB)
+
+  if !lock_state
+    puts "Already running, exiting..."
+    exit
+  end
+
+  begin
+    yield
+  ensure
+    lock_file.close
+  end
+end
+
+def authenticated_url(config, clone_url, login)
+  uri = URI.parse(clone_url)
+  return clone_url if uri.scheme == "file"
+
+  "#{uri.scheme}://#{auth_provider(config).git_username || login}:#{config[:github_secret]}@#{uri.host}#{uri.path}"
+end
+
+def branch_tips(path)
+  output, _ = Open3.capture2('git', '-C', path, 'for-each-ref', '--format=%(refname:short) %(objectname)', 'refs/heads')
+  output.lines.map(&:split).to_h
+end
+
+def branch_activity(path, previous, log_length)
+  tips = branch_tips(path)
+  return [tips, {}] if previous.nil?
+
+  excluded = previous.values.map { |tip| "^#{tip}" }
+  activity = {}
+
+  tips.each do |branch, tip|
+    next if previous[branch] == tip
+
+    revisions = ([tip] + excluded).join("\n")
+    count, _ = Open3.capture2('git', '-C', path, 'rev-list', '--count', '--ignore-missing', '--stdin', stdin_data: revisions)
+    activity[branch] = { "commits" => count.to_i }
+
+    if log_length > 0
+      log, _ = Open3.capture2('git', '-C', path, 'log', "-n#{log_length}", '--format=%h %s', '--ignore-missing', '--stdin', stdin_data: revisions)
+      activity[branch]["log"] = log.lines.map(&:chomp)
+    end
+  end
+
+  (previous.keys - tips.keys).each { |branch| activity[branch] = { "deleted" => true } }
+
+  [tips, activity]
+end
+
+def emit(event, fields = {})
+  return if $events.nil?
+
+  $events.write({ "event" => event, "at" => Time.now.utc.iso8601 }.merge(fields).to_json + "\n")
+end
+
+def timed(timings, phase, full_name)
+  started = Process.clock_gettime(Process::CLOCK_MONOTONIC)
+  yield
+ensure
+  duration = Process.clock_gettime(Process::CLOCK_MONOTONIC) - started
+  timings[phase] = (timings[phase] || 0) + duration
+  emit("phase_finished", "repository" => full_name, "phase" => phase, "duration" => duration.round(2))
+end
+
+def mirror_ids(config, run)
+  run[:mutex].synchronize do
+    run[:mirror_ids] ||= mirror_paths(config[:backup_folder]).map { |full_name, path| [read_marker(path)["id"], full_name] }.select(&:first).to_h
+  end
+end
+
+# Repositories that are transferred or renamed keep their ID, so when a
+# repository has no mirror under its current name but one with the same ID
+# exists the mirror and its metadata are moved rather than cloned again. The
+# old name is recorded in the state file.
+def consolidate_transfer(config, run, repo)
+  previous = mirror_ids(config, run)[repo[:id]]
+  return if previous.nil? || previous == repo[:full_name]
+
+  puts "#{previous} was transferred to #{repo[:full_name]}, moving its backup..."
+
+  moves = [
+    [mirror_path(config, previous), mirror_path(config, repo[:full_name])],
+    [metadata_folder(config, previous), metadata_folder(config, repo[:full_name])]
+  ]
+
+  moves.each do |from, to|
+    next unless File.exist?(from) && !File.exist?(to)
+
+    FileUtils.mkdir_p(File.dirname(to))
+    File.rename(from, to)
+  end
+
+  run[:mutex].synchronize do
+    run[:mirror_ids][repo[:id]] = repo[:full_name]
+    tips = run[:state]["tips"] ||= {}
+    tips[repo[:full_name]] = tips.delete(previous) if tips.key?(previous)
+    (run[:state]["transfers"] ||= {})[previous] = { "to" => repo[:full_name], "at" => Time.now.utc.iso8601 }
+  end
+end
+
+def shrinkage_before_fetch(config, path, url)
+  local = mirror_refs(path).keys.select { |ref| ref.start_with?("refs/heads/", "refs/tags/") }
+  return nil if local.empty?
+
+  output, status = Open3.capture2('git', 'ls-remote', url, err: File::NULL)
+  return nil unless status.success?
+
+  deleted = local - output.lines.map { |line| line.split[1] }
+  return nil if deleted.size * 100.0 / local.size < config[:shrink_threshold]
+
+  "#{deleted.size} of #{local.size} branches and tags were deleted upstream"
+end
+
+def shrinkage_after_fetch(config, path, previous_tips)
+  return nil if previous_tips.nil? || previous_tips.empty?
+
+  tips = previous_tips.values.uniq
+  total, _ = Open3.capture2('git', '-C', path, 'rev-list', '--count', '--ignore-missing', *tips)
+  lost, _ = Open3.capture2('git', '-C', path, 'rev-list', '--count', '--ignore-missing', *tips, '--not', '--all')
+  return nil if total.to_i.zero? || lost.to_i * 100.0 / total.to_i < config[:shrink_threshold]
+
+  "#{lost.to_i} of #{total.to_i} commits are no longer reachable from any branch"
+end
+
+# Alerts on a repository that has shrunk sharply, e.g. after a force push or
+# branches being deleted, and turns off automatic garbage collection for the
+# mirror so the commits that are no longer reachable are kept until the
+# shrinkage is acknowledged.
+def record_shrinkage(config, run, full_name, path, reason, previous_tips)
+  annotate(config, "error", "#{full_name} shrank sharply: #{reason}")
+  execute('git', '-C', path, 'config', 'gc.auto', '0')
+
+  run[:mutex].synchronize do
+    run[:warnings] << "#{full_name} shrank sharply: #{reason}"
+    (run[:state]["shrinkage"] ||= {})[full_name] = { "at" => Time.now.utc.iso8601, "reason" => reason, "tips" => previous_tips }
+  end
+end
+
+def promote_snapshot(delayed_path, path, refs)
+  upload_pack = "git -c uploadpack.allowAnySHA1InWant=true upload-pack"
+  refspecs = refs.map { |ref, sha| "+#{sha}:#{ref}" }
+
+  if refspecs.any?
+    return false unless execute('git', '-C', delayed_path, 'fetch', '--quiet', '--upload-pack', upload_pack, File.expand_path(path), *refspecs)
+  end
+
+  (mirror_refs(delayed_path).keys - refs.keys).each { |ref| execute('git', '-C', delayed_path, 'update-ref', '-d', ref) }
+
+  head, _ = Open3.capture2('git', '-C', path, 'symbolic-ref', 'HEAD')
+  execute('git', '-C', delayed_path, 'symbolic-ref', 'HEAD', head.strip) unless head.strip.empty?
+  true
+end
+
+# Keeps a second copy of the mirror under _delayed/ that lags DELAYED_MIRROR
+# days behind. The refs after every fetch are recorded as a snapshot in the
+# copy's marker, and the newest snapshot that has aged past the delay is
+# applied to the copy, unless the repository has an unacknowledged shrinkage
+# alert, so a compromised account's rewritten history only reaches the copy
+# if nobody notices for that long.
+def update_delayed(config, run, full_name, path)
+  delayed_path = "#{config[:backup_folder]}/_delayed/#{stored_name(config, full_name)}.git"
+  return false unless Dir.exist?(delayed_path) || execute('git', 'init', '--quiet', '--bare', delayed_path)
+
+  snapshots = read_marker(delayed_path)["snapshots"] || []
+  refs = mirror_refs(path)
+  snapshots << { "at" => Time.now.utc.iso8601, "refs" => refs } if snapshots.empty? || snapshots.last["refs"] != refs
+
+  cutoff = Time.now.utc - config[:delayed_mirror] * 86400
+  aged, pending = snapshots.partition { |snapshot| Time.parse(snapshot["at"]) <= cutoff }
+  shrunk = run[:mutex].synchronize { (run[:state]["shrinkage"] || {}).key?(full_name) }
+
+  if aged.any? && !shrunk
+    promoted = aged.last["promoted"] || promote_snapshot(delayed_path, path, aged.last["refs"])
+    snapshots = [aged.last.merge("promoted" => true)] + pending if promoted
+  end
+
+  write_marker(delayed_path, "full_name" => full_name, "snapshots" => snapshots)
+  true
+end
+
+def acknowledge(full_name)
+  abort "Usage: ghbackup acknowledge <owner>/<repo>" if full_name.nil?
+
+  config = load_config
+
+  with_lock do
+    state = load_state(config[:backup_folder])
+    shrinkage = (state["shrinkage"] || {}).delete(full_name)
+    abort "No shrinkage recorded for #{full_name}" if shrinkage.nil?
+
+    path = mirror_path(config, full_name)
+    system('git', '-C', path, 'config', '--unset', 'gc.auto') if Dir.exist?(path)
+
+    save_state(config[:backup_folder], state)
+    puts "Acknowledged #{full_name}: #{shrinkage["reason"]}"
+  end
+end
+
+# MODE=snapshot skips git entirely and downloads a tarball of each
+# repository's default branch to <owner>/<repo>/<timestamp>.tar.gz, only when
+# it has been pushed to since the last snapshot.
+def download_snapshot(config, run, client, repo)
+  pushed_at = repo[:pushed_at].to_s
+  previous = run[:mutex].synchronize { (run[:state]["snapshots"] ||= {})[repo[:full_name]] }
+  return true if !pushed_at.empty? && previous == pushed_at
+
+  begin
+    uri = URI(client.archive_link(repo[:full_name], format: "tarball", ref: repo[:default_branch]))
+  rescue Octokit::NotFound
+    puts "#{repo[:full_name]} is empty, nothing to snapshot"
+    return true
+  end
+
+  path = "#{config[:backup_folder]}/#{stored_name(config, repo[:full_name])}/#{run[:started_at].strftime("%Y%m%dT%H%M%SZ")}.tar.gz"
+  FileUtils.mkdir_p(File.dirname(path))
+
+  response = Net::HTTP.start(uri.host, uri.port, use_ssl: uri.scheme == "https") do |http|
+    http.request(Net::HTTP::Get.new(uri, "User-Agent" => user_agent(config))) do |chunked|
+      next unless chunked.is_a?(Net::HTTPSuccess)
+
+      File.open("#{path}.tmp", "wb") { |file| chunked.read_body { |chunk| file.write(chunk) } }
+    end
+  end
+
+  unless response.is_a?(Net::HTTPSuccess)
+    puts "Downloading the snapshot of #{repo[:full_name]} failed with #{response.code}"
+    return false
+  end
+
+  File.rename("#{path}.tmp", path)
+  run[:mutex].synchronize { run[:state]["snapshots"][repo[:full_name]] = pushed_at }
+  true
+ensure
+  FileUtils.rm_f("#{path}.tmp") if path
+end
+
+def backup_repository(config, run, client, repo)
+  authenitcated_clone_url = authenticated_url(config, repo[:clone_url], run[:login])
+
+  backup_path = mirror_path(config, repo[:full_name])
+  metadata_path = metadata_folder(config, repo[:full_name])
+  timings = {}
+  refs = config[:repo_config].dig(repo[:full_name], "refs")
+  refs = (refs + NOTES_REFS).uniq if refs && config[:include_notes]
+
+  consolidate_transfer(config, run, repo) unless Dir.exist?(backup_path)
+
+  previous_tips = run[:mutex].synchronize { (run[:state]["tips"] ||= {})[repo[:full_name]] }
+  previous_size = Dir.exist?(backup_path) ? object_size(backup_path) : 0
+
+  record_activity = lambda do |path|
+    tips, activity = branch_activity(path, previous_tips, config[:activity_log])
+    fetched = [object_size(path) - previous_size, 0].max
+
+    run[:mutex].synchronize do
+      run[:state]["tips"][repo[:full_name]] = tips
+      run[:activity][repo[:full_name]] = activity if activity.any?
+      record_schedule(run[:state], repo[:full_name], tips != previous_tips)
+      (run[:state]["fetched"] ||= {})[repo[:full_name]] = ((run[:state]["fetched"][repo[:full_name]] || []) + [fetched]).last(10)
+      run[:usage].transfer(fetched)
+    end
+  end
+
+  log_path = "#{config[:backup_folder]}/.ghbackup/logs/#{stored_name(config, repo[:full_name])}.log" if config[:command_logs]
+  log = Thread.current[:command_log] = CommandLog.new(log_path)
+  Thread.current[:command_timeout] = config[:fetch_timeout] * 60 if config[:fetch_timeout] > 0
+
+  p "Backing up #{repo[:full_name]}..."
+  emit("repository_started", "repository" => repo[:full_name])
+
+  if config[:shrink_threshold] > 0 && config[:age_recipients].empty? && Dir.exist?(backup_path)
+    held = config[:shrink_protection] && run[:mutex].synchronize { (run[:state]["shrinkage"] || {}).key?(repo[:full_name]) }
+    reason = held ? nil : shrinkage_before_fetch(config, backup_path, authenitcated_clone_url)
+    record_shrinkage(config, run, repo[:full_name], backup_path, reason, previous_tips) if reason
+
+    if config[:shrink_protection] && (held || reason)
+      puts "Not fetching #{repo[:full_name]} until it's acknowledged with ghbackup acknowledge #{repo[:full_name]}"
+      return false
+    end
+  end
+
+  if config[:max_refs] > 0 && config[:mode] != "snapshot" && remote_ref_count(authenitcated_clone_url, config[:max_refs]) > config[:max_refs]
+    raise LimitExceeded, "more than #{config[:max_refs]} refs"
+  end
+
+  if config[:keep_previous] && config[:mode] != "snapshot" && config[:age_recipients].empty? && Dir.exist?(backup_path)
+    timed(timings, "previous", repo[:full_name]) { rotate_previous(backup_path) }
+  end
+
+  success = timed(timings, "fetch", repo[:full_name]) do
+    if config[:mode] == "snapshot"
+      download_snapshot(config, run, client, repo)
+    elsif config[:age_recipients].any?
+      artifact = artifact_name(stored_name(config, repo[:full_name]), config[:run_tag])
+      encrypted = backup_encrypted(authenitcated_clone_url, repo[:full_name], "#{config[:backup_folder]}/#{artifact}", workspace(config), config[:age_recipients], refs, seed_path(config, repo[:full_name]), &record_activity)
+
+      if encrypted
+        run[:mutex].synchronize do
+          key = artifact_key(repo[:full_name], config[:run_tag])
+          previous = run[:manifest]["artifacts"].dig(key, "path")
+          FileUtils.rm_f("#{config[:backup_folder]}/#{previous}") if previous && previous != artifact
+          record_artifact(run[:manifest], key, artifact, config[:key_generation], config[:run_tag])
+          run[:manifest]["artifacts"][key]["refs"] = refs
+          run[:manifest]["artifacts"][key]["sha256"] = Digest::SHA256.file("#{config[:backup_folder]}/#{artifact}").hexdigest
+          save_manifest(config[:backup_folder], run[:manifest])
+        end
+      end
+
+      encrypted
+    elsif Dir.exist?(backup_path)
+      update_mirror(backup_path, refs, authenitcated_clone_url)
+    else
+      clone_mirror(authenitcated_clone_url, backup_path, refs, seed_path(config, repo[:full_name]))
+    end
+  end
+
+  if success && Dir.exist?(backup_path)
+    FileUtils.touch("#{backup_path}/git-daemon-export-ok")
+    write_marker(backup_path, "id" => repo[:id], "full_name" => repo[:full_name], "partial" => !refs.nil?, "refs" => refs, "normalized" => config[:name_normalization])
+    repair_head(backup_path, repo[:full_name], config[:repo_config].dig(repo[:full_name], "default_branch") || repo[:default_branch])
+    update_search_index(backup_path) if config[:search_index]
+
+    if config[:shrink_threshold] > 0
+      reason = shrinkage_after_fetch(config, backup_path, previous_tips)
+      record_shrinkage(config, run, repo[:full_name], backup_path, reason, previous_tips) if reason
+    end
+
+    if config[:delayed_mirror] > 0
+      timed(timings, "delayed", repo[:full_name]) { update_delayed(config, run, repo[:full_name], backup_path) }
+    end
+
+    timed(timings, "activity", repo[:full_name]) { record_activity.call(backup_path) }
+  end
+
+  if success && config[:export_dir] && config[:age_recipients].empty? && Dir.exist?(backup_path)
+    export = timed(timings, "export", repo[:full_name]) { export_packs(backup_path, config[:export_dir]) }
+    run[:mutex].synchronize { run[:exports][repo[:full_name]] = export }
+  end
+
+  timed(timings, "metadata", repo[:full_name]) do
+    enabled_collectors(config).each do |collector|
+      run_collector(config, run, client, repo, collector, metadata_path)
+    end
+  end
+
+  success
+rescue LimitExceeded => e
+  annotate(config, "warning", "Skipped #{repo[:full_name]}, exceeded limits: #{e.message}")
+  run[:mutex].synchronize { run[:limited][repo[:full_name]] = e.message }
+  false
+ensure
+  Thread.current[:command_log] = nil
+  Thread.current[:command_timeout] = nil
+  log&.close
+
+  run[:mutex].synchronize do
+    run[:timings][repo[:full_name]] = timings
+    if success
+      run[:errors].delete(repo[:full_name])
+    elsif log
+      run[:errors][repo[:full_name]] = log.tail
+    end
+  end
+
+  emit("repository_finished", "repository" => repo[:full_name], "success" => !!success)
+end
+
+def git_version
+  $git_version ||= command_version('git', '--version').to_s[/\d+(\.\d+)+/]
+end
+
+def git_lfs_version
+  $git_lfs_version ||= command_version('git', 'lfs', 'version').to_s[%r{git-lfs/(\d+(\.\d+)+)}, 1]
+end
+
+def git_at_least?(minimum)
+  !git_version.nil? && Gem::Version.new(git_version) >= Gem::Version.new(minimum)
+end
+
+def git_errors(config)
+  return ["git isn't installed"] if git_version.nil?
+  return ["git #{MINIMUM_GIT_VERSION} or newer is needed, found #{git_version}"] unless git_at_least?(MINIMUM_GIT_VERSION)
+
+  GIT_FEATURES.select { |setting, (minimum, _)| config[setting] && !git_at_least?(minimum) }.map do |_, (minimum, feature)|
+    "#{feature} needs git #{minimum} or newer, found #{git_version}"
+  end
+end
+
+def validate_config(name, config)
+  errors = git_errors(config)
+  errors << "unknown TOKEN_PROVIDER #{config[:token_provider]}" unless AUTH_PROVIDERS.key?(config[:token_provider])
+  errors << "TOKEN_PROVIDER=app needs GITHUB_APP_ID, GITHUB_APP_INSTALLATION_ID and GITHUB_APP_PRIVATE_KEY" if config[:token_provider] == "app" && [config[:github_app_id], config[:github_app_installation_id], config[:github_app_private_key]].any?(&:nil?)
+  errors << "SKIP_IDLE_RUNS can't be used with TOKEN_PROVIDER=app" if config[:token_provider] == "app" && config[:skip_idle_runs]
+  errors << "EXPORT_ACCOUNT can't be used with TOKEN_PROVIDER=app" if config[:token_provider] == "app" && config[:export_account]
+  errors << "unknown LIST_BACKEND #{config[:list_backend]}" unless %w[rest graphql].include?(config[:list_backend])
+  errors << "unknown OUTPUT #{config[:output]}" unless %w[text gha jsonl].include?(config[:output])
+  errors << "unknown MODE #{config[:mode]}" unless %w[scheduled events snapshot].include?(config[:mode])
+  errors << "AGE_RECIPIENTS can't be used with MODE=snapshot" if config[:mode] == "snapshot" && config[:age_recipients].any?
+  errors << "CANARY_REPO can't be used with MODE=snapshot" if config[:mode] == "snapshot" && config[:canary_repo]
+  errors << "MODE=events needs a BACKUP_INTERVAL to pick up what the events API misses" if config[:mode] == "events" && config[:backup_interval] <= 0
+  errors << "BACKUP_WINDOW must be HH:MM-HH:MM" if config[:backup_window] && config[:backup_window].size != 2
+  errors << "REPO_CONFIG must be a JSON object" unless config[:repo_config].is_a?(Hash)
+  errors << "unknown QUOTA_EVICTION #{config[:quota_eviction]}" unless %w[none archives].include?(config[:quota_eviction])
+  errors << "unknown LAYOUT #{config[:layout]}" unless %w[flat sharded].include?(config[:layout])
+  errors << "unknown NAME_NORMALIZATION #{config[:name_normalization]}" unless %w[none lowercase encode].include?(config[:name_normalization])
+  errors << "unknown NOTIFY_ON #{config[:notify_on]}" unless %w[failures always].include?(config[:notify_on])
+  errors += (config[:notify] - NOTIFIERS.keys).map { |notifier| "unknown notifier #{notifier} in NOTIFY" }
+  errors << "unknown FS_SNAPSHOT #{config[:fs_snapshot]}" unless [nil, "zfs", "btrfs"].include?(config[:fs_snapshot])
+  errors << "FS_SNAPSHOT needs FS_SNAPSHOT_TARGET" if config[:fs_snapshot] && config[:fs_snapshot_target].nil?
+  errors << "unknown NEW_REPOSITORIES #{config[:new_repositories]}" unless %w[include approve].include?(config[:new_repositories])
+  errors << "SOURCE_DIR #{config[:source_dir]} doesn't exist" if config[:source_dir] && !Dir.exist?(config[:source_dir])
+  errors << "SOURCE_DIR can't be used with REPO, MODE=events or MODE=snapshot" if config[:source_dir] && (config[:repo] || config[:mode] != "scheduled")
+
+  raise ConfigError, "Invalid configuration for #{name}: #{errors.join(", ")}" if errors.any?
+end
+
+def load_tenants
+  path = ENV["TENANTS_CONFIG"]
+
+  tenants = if path.nil?
+    [["default", load_config]]
+  else
+    raise ConfigError, "TENANTS_CONFIG #{path} doesn't exist" unless File.exist?(path)
+
+    file = JSON.parse(File.read(path))
+
+    (file["tenants"] || raise(ConfigError, "#{path} has no tenants")).map do |tenant|
+      [tenant["name"], load_config(ENV.to_h.merge(file["env"] || {}).merge(tenant["env"] || {}))]
+    end
+  end
+
+  tenants.each { |name, config| validate_config(name, config) }
+end
+
+def deprecation_warnings
+  envs = [ENV.to_h]
+
+  if ENV["TENANTS_CONFIG"]
+    file = JSON.parse(File.read(ENV["TENANTS_CONFIG"]))
+    envs += [file["env"] || {}] + (file["tenants"] || []).map { |tenant| tenant["env"] || {} }
+  end
+
+  DEPRECATED_SETTINGS.select { |old, _| envs.any? { |env| !env[old].to_s.empty? } }.map do |old, new|
+    "#{old} is deprecated, use #{new} instead (ghbackup config migrate writes an updated configuration)"
+  end
+rescue JSON::ParserError, SystemCallError
+  []
+end
+
+def config_migrate(output)
+  abort "Writing the configuration to a file can't be done with READ_ONLY=true, leave out the output to print it" if output && load_config[:read_only]
+
+  path = ENV["TENANTS_CONFIG"]
+  file = path ? JSON.parse(File.read(path)) : { "tenants" => [{ "name" => "default" }] }
+
+  env = canonical_env(ENV).slice(*CONFIG_SETTINGS - ["TENANTS_CONFIG"]).reject { |_, value| value.empty? }
+  shared = canonical_env(env.reject { |name, _| SECRET_SETTINGS.include?(name) }.merge(file["env"] || {}))
+
+  tenants = file["tenants"].map do |tenant|
+    tenant.merge("env" => canonical_env(tenant["env"] || {}))
+  end
+
+  migrated = { "env" => shared, "tenants" => tenants }
+
+  (env.keys & SECRET_SETTINGS).each do |name|
+    $stderr.puts "Left #{name} out of the configuration, keep passing it in the environment"
+  end
+
+  if output
+    write_json(output, migrated)
+    puts "Wrote #{output}, point TENANTS_CONFIG at it to use it"
+  else
+    puts JSON.pretty_generate(migrated)
+  end
+end
+
+def config_schema
+  CONFIG_SCHEMA.map do |name, setting|
+    {
+      "name" => name,
+      "type" => setting[:type].to_s,
+      "values" => setting[:values],
+      "default" => setting[:default],
+      "secret" => SECRET_SETTINGS.include?(name),
+      "deprecated_names" => DEPRECATED_SETTINGS.select { |_, new| new == name }.keys,
+      "description" => setting[:description]
+    }.compact
+  end
+end
+
+def config_docs(format)
+  if format == "json"
+    puts JSON.pretty_generate(config_schema)
+    return
+  end
+
+  puts "| Setting | Type | Default | Description |"
+  puts "| --- | --- | --- | --- |"
+
+  config_schema.each do |setting|
+    type = setting["values"] ? setting["values"].map { |value| "`#{value}`" }.join(", ") : setting["type"]
+    default = setting["default"] ? "`#{setting["default"]}`" : ""
+    notes = setting["deprecated_names"].map { |old| "previously `#{old}`" }
+    notes.unshift("secret") if setting["secret"]
+    description = setting["description"] + (notes.any? ? " (#{notes.join(", ")})" : "")
+
+    puts "| `#{setting["name"]}` | #{type} | #{default} | #{description} |"
+  end
+end
+
+def reload_tenants(current)
+  tenants = load_tenants
+  puts "Configuration changed, applying..." if tenants != current
+  tenants
+rescue ConfigError, JSON::ParserError, SystemCallError => e
+  puts "Ignoring invalid configuration, keeping the previous one: #{e.message}"
+  current
+end
+
+REPOSITORIES_QUERY = <<~GRAPHQL
+  query($cursor: String) {
+    viewer {
+      repositories(first: 100, after: $cursor, affiliations: [OWNER, COLLABORATOR, ORGANIZATION_MEMBER], ownerAffiliations: [OWNER, COLLABORATOR, ORGANIZATION_MEMBER]) {
+        pageInfo { hasNextPage endCursor }
+        nodes {
+          databaseId
+          nameWithOwner
+          url
+          pushedAt
+          diskUsage
+          isFork
+          isArchived
+          isDisabled
+          hasWikiEnabled
+          defaultBranchRef { name }
+          repositoryTopics(first: 20) { nodes { topic { name } } }
+        }
+      }
+    }
+  }
+GRAPHQL
+
+def vault_request(address, path, token, body = nil)
+  uri = URI.join(address, path)
+  request = body ? Net::HTTP::Post.new(uri) : Net::HTTP::Get.new(uri)
+  request["X-Vault-Token"] = token if token
+  request.body = body.to_json if body
+
+  response = Net::HTTP.start(uri.host, uri.port, use_ssl: uri.scheme == "https") { |http| http.request(request) }
+  raise TokenProviderError, "Vault request to #{path} failed with #{response.code}" unless response.is_a?(Net::HTTPSuccess)
+
+  JSON.parse(response.body)
+end
+
+def vault_secret(config)
+  token = config[:vault_token]
+
+  if token.nil? && config[:vault_role_id]
+    login = vault_request(config[:vault_addr], "/v1/auth/approle/login", nil, role_id: config[:vault_role_id], secret_id: config[:vault_secret_id])
+    token = login["auth"]["client_token"]
+  end
+
+  data = vault_request(config[:vault_addr], "/v1/#{config[:token_secret]}", token)["data"]
+  (data["data"] || data)[config[:token_secret_key] || "token"]
+end
+
+def command_secret(config, *command)
+  output, status = Open3.capture2(*command)
+  raise TokenProviderError, "#{command.first} exited with #{status.exitstatus}" unless status.success?
+
+  config[:token_secret_key] ? JSON.parse(output)[config[:token_secret_key]] : output.strip
+end
+
+def token_key(config, create: false)
+  path = config[:token_key_file]
+
+  if !File.exist?(path)
+    raise TokenProviderError, "No token key found at #{path}, run ghbackup login" unless create
+
+    FileUtils.mkdir_p(File.dirname(path))
+    File.open(path, File::WRONLY | File::CREAT | File::EXCL, 0600) { |file| file.write(OpenSSL::Random.random_bytes(32)) }
+  end
+
+  File.binread(path)
+end
+
+def store_token(config, token)
+  cipher = OpenSSL::Cipher.new("aes-256-gcm").encrypt
+  cipher.key = token_key(config, create: true)
+  iv = cipher.random_iv
+  ciphertext = cipher.update(token) + cipher.final
+
+  FileUtils.mkdir_p(File.dirname(config[:token_file]))
+  File.open(config[:token_file], File::WRONLY | File::CREAT | File::TRUNC, 0600) do |file|
+    file.write(Base64.strict_encode64(iv + cipher.auth_tag + ciphertext))
+  end
+end
+
+def load_stored_token(config)
+  raise TokenProviderError, "No stored token found at #{config[:token_file]}, run ghbackup login" unless File.exist?(config[:token_file])
+
+  data = Base64.strict_decode64(File.read(config[:token_file]))
+
+  cipher = OpenSSL::Cipher.new("aes-256-gcm").decrypt
+  cipher.key = token_key(config)
+  cipher.iv = data[0, 12]
+  cipher.auth_tag = data[12, 16]
+  cipher.update(data[28..-1]) + cipher.final
+rescue OpenSSL::Cipher::CipherError, ArgumentError
+  raise TokenProviderError, "Unable to decrypt the stored token at #{config[:token_file]}"
+end
+
+def user_agent(config)
+  ["ghbackup/#{VERSION} (+#{config[:user_agent_contact]})", config[:user_agent_suffix]].compact.join(" ")
+end
+
+def github_oauth_request(config, path, params)
+  uri = URI("https://github.com/login/#{path}")
+  request = Net::HTTP::Post.new(uri)
+  request["User-Agent"] = user_agent(config)
+  request.set_form_data(params)
+
+  response = Net::HTTP.start(uri.host, uri.port, use_ssl: true) { |http| http.request(request) }
+  raise TokenProviderError, "GitHub returned #{response.code} for #{path}" unless response.is_a?(Net::HTTPSuccess)
+
+  URI.decode_www_form(response.body).to_h
+end
+
+def login
+  config = load_config
+  abort "GITHUB_CLIENT_ID is required to log in" if config[:github_client_id].nil?
+
+  device = github_oauth_request(config, "device/code", client_id: config[:github_client_id], scope: "repo read:org")
+  interval = device["interval"].to_i
+  expires_at = Time.now + device["expires_in"].to_i
+
+  puts "Open #{device["verification_uri"]} and enter the code #{device["user_code"]}"
+
+  loop do
+    abort "The device code expired, run ghbackup login again" if Time.now > expires_at
+    sleep interval
+
+    response = github_oauth_request(
+      config,
+      "oauth/access_token",
+      client_id: config[:github_client_id],
+      device_code: device["device_code"],
+      grant_type: "urn:ietf:params:oauth:grant-type:device_code"
+    )
+
+    case response["error"]
+    when nil
+      store_token(config, response["access_token"])
+      puts "Logged in, token stored in #{config[:token_file]}"
+      break
+    when "authorization_pending"
+      next
+    when "slow_down"
+      interval += 5
+    else
+      abort "Unable to log in: #{response["error_description"] || response["error"]}"
+    end
+  end
+rescue TokenProviderError => e
+  abort e.message
+end
+
+def github_app_token(config)
+  key = OpenSSL::PKey::RSA.new(File.read(config[:github_app_private_key]))
+  now = Time.now.to_i
+  claims = [{ alg: "RS256", typ: "JWT" }, { iat: now - 60, exp: now + 540, iss: config[:github_app_id] }]
+  signing_input = claims.map { |claim| Base64.urlsafe_encode64(claim.to_json, padding: false) }.join(".")
+  jwt = "#{signing_input}.#{Base64.urlsafe_encode64(key.sign(OpenSSL::Digest::SHA256.new, signing_input), padding: false)}"
+
+  app = Octokit::Client.new(bearer_token: jwt, user_agent: user_agent(config))
+  app.create_app_installation_access_token(config[:github_app_installation_id])[:token]
+end
+
+# A token provider supplies the token used for both the API and git. Tokens
+# that don't belong to a user, like GitHub App installation tokens, also set
+# the username git authenticates with in place of the user's login and how
+# the repositories the token can access are listed.
+AuthProvider = Struct.new(:name, :token, :git_username, :repositories)
+AUTH_PROVIDERS = {}
+
+def register_auth_provider(name, git_username: nil, repositories: nil, &token)
+  AUTH_PROVIDERS[name] = AuthProvider.new(name, token, git_username, repositories)
+end
+
+register_auth_provider("env") { |config| config[:github_secret] }
+register_auth_provider("file") { |config| File.read(config[:github_token_file]).strip }
+register_auth_provider("login") { |config| load_stored_token(config) }
+register_auth_provider("vault") { |config| vault_secret(config) }
+
+register_auth_provider("aws") do |config|
+  command_secret(config, 'aws', 'secretsmanager', 'get-secret-value', '--secret-id', config[:token_secret], '--query', 'SecretString', '--output', 'text')
+end
+
+register_auth_provider("gcp") do |config|
+  command_secret(config, 'gcloud', 'secrets', 'versions', 'access', 'latest', "--secret=#{config[:token_secret]}")
+end
+
+register_auth_provider("app", git_username: "x-access-token", repositories: ->(client) { client.list_app_installation_repositories[:repositories] }) do |config|
+  github_app_token(config)
+end
+
+def auth_provider(config)
+  AUTH_PROVIDERS[config[:token_provider]] || raise(TokenProviderError, "Unknown token provider #{config[:token_provider]}")
+end
+
+def resolve_token(config)
+  token = auth_provider(config).token.call(config)
+  raise TokenProviderError, "#{config[:token_provider]} returned an empty token" if token.to_s.empty?
+
+  config.merge(github_secret: token)
+rescue SystemCallError, SocketError, JSON::ParserError, OpenSSL::PKey::PKeyError, Octokit::Error => e
+  raise TokenProviderError, "Unable to fetch token from #{config[:token_provider]}: #{e.message}"
+end
+
+def account_login(client, config)
+  auth_provider(config).git_username || client.user[:login]
+end
+
+def build_client(config)
+  Octokit::Client.new(
+    access_token: config[:github_secret],
+    user_agent: user_agent(config),
+    middleware: CLIENT_MIDDLEWARE,
+    connection_options: {
+      request: {
+        open_timeout: config[:api_open_timeout],
+        timeout: config[:api_timeout]
+      }
+    }
+  )
+end
+
+def graphql(client, query, variables = {})
+  response = client.post("graphql", { query: query, variables: variables })
+  raise Octokit::Error, response[:errors].map { |error| error[:message] }.join(", ") if response[:errors]
+
+  response[:data]
+end
+
+def graphql_repositories(client)
+  repositories = []
+  cursor = nil
+
+  loop do
+    page = graphql(client, REPOSITORIES_QUERY, cursor: cursor)[:viewer][:repositories]
+
+    page[:nodes].each do |node|
+      repositories << {
+        id: node[:databaseId],
+        full_name: node[:nameWithOwner],
+        clone_url: "#{node[:url]}.git",
+        default_branch: node[:defaultBranchRef] && node[:defaultBranchRef][:name],
+        pushed_at: node[:pushedAt],
+        size: node[:diskUsage],
+        fork: node[:isFork],
+        archived: node[:isArchived],
+        disabled: node[:isDisabled],
+        has_wiki: node[:hasWikiEnabled],
+        topics: node[:repositoryTopics][:nodes].map { |topic| topic[:topic][:name] }
+      }
+    end
+
+    break unless page[:pageInfo][:hasNextPage]
+    cursor = page[:pageInfo][:endCursor]
+  end
+
+  repositories
+end
+
+ENTERPRISE_ORGANIZATIONS_QUERY = <<~GRAPHQL
+  query($slug: String!, $cursor: String) {
+    enterprise(slug: $slug) {
+      organizations(first: 100, after: $cursor) {
+        pageInfo { hasNextPage endCursor }
+        nodes { login }
+      }
+    }
+  }
+GRAPHQL
+
+def enterprise_organizations(client, slug)
+  organizations = []
+  cursor = nil
+
+  loop do
+    enterprise = graphql(client, ENTERPRISE_ORGANIZATIONS_QUERY, slug: slug, cursor: cursor)[:enterprise]
+    raise Octokit::Error, "Enterprise #{slug} not found or not visible to the token" if enterprise.nil?
+
+    page = enterprise[:organizations]
+    organizations.concat(page[:nodes].map { |node| node[:login] })
+
+    break unless page[:pageInfo][:hasNextPage]
+    cursor = page[:pageInfo][:endCursor]
+  end
+
+  organizations
+end
+
+def enterprise_repositories(client, slug)
+  enterprise_organizations(client, slug).flat_map do |organization|
+    client.org_repos(organization, type: "all")
+  end
+end
+
+# SOURCE_DIR stands in for GitHub when rehearsing a setup. Every git
+# repository at <owner>/<repo> or <owner>/<repo>.git below it is listed as if
+# it were on GitHub and cloned from its file:// URL, without using the API.
+def source_repositories(source_dir)
+  Dir.glob("#{source_dir}/*/*").select { |path| File.directory?("#{path}/objects") || File.directory?("#{path}/.git") }.sort.map do |path|
+    full_name = path.delete_prefix("#{source_dir}/").delete_suffix(".git")
+    head, _ = Open3.capture2('git', '-C', path, 'symbolic-ref', '--short', 'HEAD', err: File::NULL)
+
+    {
+      id: Digest::SHA256.hexdigest(full_name)[0, 8].to_i(16),
+      full_name: full_name,
+      clone_url: "file://#{File.expand_path(path)}",
+      default_branch: head.strip,
+      pushed_at: nil,
+      size: disk_usage(path) / 1024,
+      fork: false,
+      archived: false,
+      disabled: false,
+      has_wiki: false,
+      topics: []
+    }
+  end
+end
+
+def list_repositories(client, config)
+  repositories = if config[:source_dir]
+    source_repositories(config[:source_dir])
+  elsif config[:enterprise]
+    enterprise_repositories(client, config[:enterprise])
+  elsif auth_provider(config).repositories
+    auth_provider(config).repositories.call(client)
+  elsif config[:list_backend] == "graphql"
+    graphql_repositories(client)
+  else
+    client.repos
+  end
+
+  repositories.uniq { |repo| repo[:full_name] }.select { |repo| selected?(config, repo[:full_name]) }
+end
+
+# Lists each tenant's repositories with both the REST and GraphQL APIs and
+# reports any that only one of them returns, so LIST_BACKEND=graphql can be
+# checked to back up the same repositories before switching to it.
+def check_listing
+  Octokit.configure do |c|
+    c.auto_paginate = true
+  end
+
+  different = load_tenants.count do |name, config|
+    if config[:source_dir] || config[:enterprise] || auth_provider(config).repositories
+      puts "#{name}: not listed with LIST_BACKEND, skipping"
+      next false
+    end
+
+    client = build_client(resolve_token(config))
+    rest = client.repos.map { |repo| repo[:full_name] }.uniq
+    graphql = graphql_repositories(client).map { |repo| repo[:full_name] }.uniq
+
+    if rest.sort == graphql.sort
+      puts "#{name}: REST and GraphQL both list the same #{rest.size} repositories"
+      next false
+    end
+
+    puts "#{name}: REST and GraphQL list different repositories"
+    (rest - graphql).sort.each { |full_name| puts "  only REST: #{full_name}" }
+    (graphql - rest).sort.each { |full_name| puts "  only GraphQL: #{full_name}" }
+    true
+  end
+
+  exit 1 if different > 0
+rescue Octokit::Error, Faraday::Error, TokenProviderError => e
+  abort "Listing repositories failed: #{e.message}"
+end
+
+def selected?(config, full_name)
+  included = config[:repo_include].empty? || config[:repo_include].any? { |pattern| File.fnmatch(pattern, full_name) }
+  excluded = config[:repo_exclude].any? { |pattern| File.fnmatch(pattern, full_name) }
+
+  included && !excluded
+end
+
+def due?(config, state)
+  last_started_at = state.dig("last_run", "started_at")
+  return true if config[:backup_interval] <= 0 || last_started_at.nil?
+
+  Time.now.utc - Time.parse(last_started_at) >= config[:backup_interval] * 3600 - 300
+end
+
+def cached_login(client, config, state)
+  digest = Digest::SHA256.hexdigest(config[:github_secret].to_s)
+  cached = state["user"]
+  return cached["login"] if cached && cached["token_digest"] == digest
+
+  login = account_login(client, config)
+  state["user"] = { "login" => login, "token_digest" => digest }
+  login
+end
+
+def latest_event_id(client, login)
+  client.auto_paginate = false
+  event = client.user_events(login, per_page: 1).first
+  event && event[:id]
+ensure
+  client.auto_paginate = true
+end
+
+def idle?(config, state, event_id)
+  last_started_at = state.dig("last_run", "started_at")
+  return false if event_id.nil? || last_started_at.nil?
+  return false if Time.now.utc - Time.parse(last_started_at) > config[:skip_idle_max_age] * 3600
+
+  state["last_event_id"] == event_id
+end
+
+def token_expiry(client)
+  return nil if client.last_response.nil?
+
+  expiration = client.last_response.headers["github-authentication-token-expiration"]
+  expiration && Time.parse(expiration).utc
+end
+
+# Orders the queue so the slowest repositories start first and the run doesn't
+# end with a single worker busy on one large repository. Repositories that
+# have never been backed up need a full clone so go first, largest first by
+# their reported size, followed by the rest by how long they took last time.
+def largest_first(repositories, state)
+  durations = state["durations"] || {}
+
+  repositories.sort_by do |repo|
+    duration = durations[repo[:full_name]]
+    duration ? [1, -duration] : [0, -(repo[:size] || 0)]
+  end
+end
+
+# With SMART_SCHEDULE=true repositories that rarely change are fetched less
+# often. Each waits a quarter of the average time between its recent changes,
+# at most SMART_SCHEDULE_MAX days, unless GitHub reports a push since it was
+# last fetched. New repositories and those without a history are always due.
+def due_for_update?(config, state, repo, now = Time.now.utc)
+  schedule = (state["schedule"] || {})[repo[:full_name]]
+  return true if schedule.nil? || schedule["changes"].empty?
+
+  updated_at = Time.parse(schedule["updated_at"])
+  return true if repo[:pushed_at] && Time.parse(repo[:pushed_at].to_s) > updated_at
+
+  gaps = (schedule["changes"].map { |change| Time.parse(change) } + [now]).each_cons(2).map { |from, to| to - from }
+  wait = [gaps.sum / gaps.size / 4, config[:smart_schedule_max] * 86400].min
+
+  now - updated_at >= wait
+end
+
+def record_schedule(state, full_name, changed)
+  now = Time.now.utc.iso8601
+  schedule = (state["schedule"] ||= {})[full_name] ||= { "changes" => [] }
+  schedule["changes"] = (schedule["changes"] + [now]).last(10) if changed || schedule["changes"].empty?
+  schedule["updated_at"] = now
+end
+
+# Size of a repository's objects, the growth between runs is roughly what was
+# fetched. Encrypted backups fetch into an empty workspace so it's their whole
+# size.
+def object_size(path)
+  Dir.glob("#{path}/objects/**/*").sum { |file| File.file?(file) ? File.size(file) : 0 }
+end
+
+def parse_size(size)
+  return nil if size.nil? || size.empty?
+
+  number, unit = size.upcase.match(/\A([\d.]+)\s*([KMGT]?)B?\z/)&.captures
+  raise ConfigError, "Invalid size #{size}" if number.nil?
+
+  (number.to_f * 1024**" KMGT".index(unit.empty? ? " " : unit)).to_i
+end
+
+def evict_archives(config, run, excess)
+  manifest = run[:manifest]
+  tagged = manifest["artifacts"].select { |_, artifact| artifact["run_tag"] }.sort_by { |_, artifact| artifact["updated_at"] }
+  freed = 0
+
+  tagged.each do |key, artifact|
+    break if freed >= excess
+
+    path = "#{config[:backup_folder]}/#{artifact["path"]}"
+    freed += File.size(path) if File.exist?(path)
+    FileUtils.rm_f(path)
+    manifest["artifacts"].delete(key)
+    puts "Removed #{artifact["path"]} to stay within MAX_TOTAL_SIZE"
+  end
+
+  save_manifest(config[:backup_folder], manifest) if freed > 0
+  freed
+end
+
+# Keeps the backup folder within MAX_TOTAL_SIZE. Repositories that are already
+# backed up are always updated, but new ones are only added when their reported
+# size fits in what's left (after evicting old tagged archives when
+# QUOTA_EVICTION=archives).
+def enforce_quota(config, run, queue)
+  return queue if config[:max_total_size].nil?
+
+  existing = lambda do |repo|
+    Dir.exist?(mirror_path(config, repo[:full_name])) ||
+      run[:manifest]["artifacts"].key?(artifact_key(repo[:full_name], config[:run_tag]))
+  end
+
+  usage = disk_usage(config[:backup_folder])
+  projected = usage + queue.reject(&existing).sum { |repo| (repo[:size] || 0) * 1024 }
+  return queue if projected <= config[:max_total_size]
+
+  usage -= evict_archives(config, run, projected - config[:max_total_size]) if config[:quota_eviction] == "archives"
+
+  accepted = []
+  dropped = []
+
+  queue.each do |repo|
+    if existing.call(repo)
+      accepted << repo
+    elsif usage + (repo[:size] || 0) * 1024 <= config[:max_total_size]
+      usage += (repo[:size] || 0) * 1024
+      accepted << repo
+    else
+      dropped << repo
+    end
+  end
+
+  if dropped.any?
+    warning = "Backup folder is over MAX_TOTAL_SIZE (#{human_size(usage)} of #{human_size(config[:max_total_size])}), #{dropped.size} new repositories not backed up: #{dropped.map { |repo| repo[:full_name] }.join(", ")}"
+    annotate(config, "error", warning)
+    run[:warnings] << warning
+  end
+
+  accepted
+end
+
+def new_run(login, state, config)
+  started_at = Time.now.utc
+
+  {
+    login: login,
+    started_at: started_at,
+    state: state,
+    manifest: load_manifest(config[:backup_folder]),
+    exports: {},
+    timings: {},
+    activity: {},
+    repositories: [],
+    failed: [],
+    errors: {},
+    deferred: {},
+    collectors: {},
+    warnings: [],
+    not_due: [],
+    limited: {},
+    new_repositories: [],
+    frozen: [],
+    usage: RunUsage.new,
+    transcript: config[:transcripts] ? Transcript.new("#{config[:backup_folder]}/.ghbackup/transcripts/#{started_at.strftime("%Y%m%dT%H%M%SZ")}.sh", started_at) : nil,
+    mutex: Mutex.new
+  }
+end
+
+# Appends the audit log of every organization the user owns to
+# _audit/<org>.ndjson. GitHub only keeps audit logs for a limited time, so each
+# run fetches the days since the newest exported event and appends the events
+# that are newer than it.
+def export_audit_logs(config, run, client)
+  cursors = run[:state]["audit_log"] ||= {}
+
+  admin_organizations(client).each do |org|
+    since = cursors[org]
+    attempts = 0
+
+    options = { order: "asc", per_page: 100 }
+    options[:phrase] = "created:>=#{Time.at(since / 1000).utc.strftime("%Y-%m-%d")}" if since
+
+    begin
+      events = client.paginate("orgs/#{org}/audit-log", options).map(&:to_attrs).select { |event| since.nil? || event[:"@timestamp"] > since }
+    rescue *RATE_LIMIT_ERRORS, Octokit::ServerError => e
+      attempts += 1
+      raise if attempts == 3
+
+      puts "Exporting the audit log for #{org} failed, retrying: #{e.message}"
+      sleep 30 * attempts
+      retry
+    end
+
+    next if events.empty?
+
+    path = "#{config[:backup_folder]}/_audit/#{org}.ndjson"
+    FileUtils.mkdir_p(File.dirname(path))
+    File.open(path, "a") { |file| events.each { |event| file.puts(event.to_json) } }
+
+    cursors[org] = events.map { |event| event[:"@timestamp"] }.max
+    puts "Exported #{events.size} audit log events for #{org}"
+  rescue Octokit::Error => e
+    # AbuseDetected is a Forbidden too, but the audit log is there
+    if [Octokit::NotFound, Octokit::Forbidden].any? { |error| e.is_a?(error) } && RATE_LIMIT_ERRORS.none? { |error| e.is_a?(error) }
+      annotate(config, "warning", "The audit log for #{org} isn't available: #{e.message}")
+      next
+    end
+
+    # GitHub only keeps audit logs for a limited time, so this can't go unnoticed
+    warning = "Unable to export the audit log for #{org}, it's behind since #{since ? Time.at(since / 1000).utc.iso8601 : "the start"}: #{e.message}"
+    annotate(config, "error", warning)
+    run[:warnings] << warning
+  end
+rescue Octokit::Error => e
+  annotate(config, "warning", "Unable to list organization memberships for the audit log: #{e.message}")
+end
+
+def admin_organizations(client)
+  client.organization_memberships(state: "active").select { |membership| membership[:role] == "admin" }.map { |membership| membership[:organization][:login] }
+end
+
+# Writes the webhooks and GitHub App installations of every organization the
+# user owns to _organizations/<org>/, with the repositories each installation
+# was granted, so integrations can be set up again after restoring the
+# organization. Webhook secrets aren't returned by GitHub.
+def export_org_integrations(config, client)
+  admin_organizations(client).each do |org|
+    path = "#{config[:backup_folder]}/_organizations/#{org}"
+
+    write_json("#{path}/webhooks.json", client.org_hooks(org).map(&:to_attrs))
+
+    installations = client.get("orgs/#{org}/installations", per_page: 100)[:installations].map do |installation|
+      attributes = installation.to_attrs
+
+      if installation[:repository_selection] == "selected"
+        begin
+          attributes[:repositories] = client.find_installation_repositories_for_user(installation[:id])[:repositories].map { |repo| repo[:full_name] }
+        rescue *RATE_LIMIT_ERRORS
+          raise
+        rescue Octokit::Error => e
+          # Only a GitHub App user token can list them, a personal access token can't
+          attributes[:repositories] = nil
+          attributes[:repositories_error] = e.message
+        end
+      end
+
+      attributes
+    end
+
+    write_json("#{path}/installations.json", installations)
+    puts "Exported #{installations.size} app installations and the webhooks of #{org}"
+  rescue *RATE_LIMIT_ERRORS
+    raise
+  rescue Octokit::Error => e
+    annotate(config, "warning", "Unable to export the integrations of #{org}: #{e.message}")
+  end
+rescue Octokit::Error => e
+  annotate(config, "warning", "Unable to list organization memberships for the integrations: #{e.message}")
+end
+
+# Repositories that appear upstream for the first time are listed in the run
+# report, or with NEW_REPOSITORIES=approve held back until they're approved
+# with ghbackup approve. Everything listed in the first run counts as seen.
+def review_new_repositories(config, run, state, queue)
+  now = Time.now.utc.iso8601
+
+  if state["seen"].nil?
+    state["seen"] = queue.map { |repo| [repo[:full_name], now] }.to_h
+    return queue
+  end
+
+  new = queue.reject { |repo| state["seen"].key?(repo[:full_name]) }
+  return queue if new.empty?
+
+  if config[:new_repositories] == "approve"
+    pending = state["pending_approval"] ||= {}
+    new.each { |repo| pending[repo[:full_name]] ||= now }
+
+    warning = "#{new.size} new repositories waiting for approval with ghbackup approve: #{new.map { |repo| repo[:full_name] }.join(", ")}"
+    annotate(config, "warning", warning)
+    run[:warnings] << warning
+
+    queue - new
+  else
+    new.each { |repo| state["seen"][repo[:full_name]] = now }
+    run[:new_repositories] = new.map { |repo| repo[:full_name] }
+    puts "#{new.size} new repositories added: #{run[:new_repositories].join(", ")}"
+
+    queue
+  end
+end
+
+# Frozen repositories aren't fetched, keeping their backup exactly as it is,
+# e.g. ahead of an upstream force push, but are still verified, served and
+# reported on. Repositories are frozen with "frozen": true in REPO_CONFIG or
+# with ghbackup freeze.
+def repository_frozen?(config, state, full_name)
+  config[:repo_config].dig(full_name, "frozen") == true || (state["frozen"] || {}).key?(full_name)
+end
+
+def set_frozen(full_name, reason, frozen)
+  abort "Usage: ghbackup #{frozen ? "freeze <owner>/<repo> [<reason>]" : "unfreeze <owner>/<repo>"}" if full_name.nil?
+
+  config = load_config
+
+  with_lock do
+    state = load_state(config[:backup_folder])
+
+    if frozen
+      (state["frozen"] ||= {})[full_name] = { "at" => Time.now.utc.iso8601, "reason" => reason }
+      puts "Froze #{full_name}, it won't be fetched until it's unfrozen"
+    else
+      abort "#{full_name} isn't frozen" unless (state["frozen"] || {}).delete(full_name)
+      puts "Unfroze #{full_name}"
+      puts "#{full_name} is still frozen in REPO_CONFIG" if config[:repo_config].dig(full_name, "frozen") == true
+    end
+
+    save_state(config[:backup_folder], state)
+  end
+end
+
+def approve(full_name)
+  abort "Usage: ghbackup approve <owner>/<repo>|--all" if full_name.nil?
+
+  config = load_config
+
+  with_lock do
+    state = load_state(config[:backup_folder])
+    pending = state["pending_approval"] || {}
+    names = full_name == "--all" ? pending.keys : [full_name]
+    abort "#{full_name} isn't waiting for approval" unless (names - pending.keys).empty?
+
+    names.each do |name|
+      pending.delete(name)
+      (state["seen"] ||= {})[name] = Time.now.utc.iso8601
+      puts "Approved #{name}, it will be backed up in the next run"
+    end
+
+    save_state(config[:backup_folder], state)
+  end
+end
+
+def prepare_tenant(name, config)
+  state = load_state(config[:backup_folder])
+
+  if !due?(config, state)
+    puts "Skipping #{name}, not due yet..."
+    return nil
+  end
+
+  puts "Running backup for #{name}..."
+  Thread.current[:transcript] = nil
+
+  check_permissions(config)
+
+  if config[:source_dir]
+    client = nil
+    login = "local"
+  else
+    config = resolve_token(config)
+    client = build_client(config)
+    login = cached_login(client, config, state)
+  end
+
+  if config[:skip_idle_runs] && client
+    event_id = latest_event_id(client, login)
+
+    if idle?(config, state, event_id)
+      puts "Skipping #{name}, no activity since the last run..."
+      return nil
+    end
+
+    state["last_event_id"] = event_id
+  end
+
+  run = new_run(login, state, config)
+  Thread.current[:usage] = run[:usage]
+  Thread.current[:transcript] = [run[:transcript], nil]
+  emit("run_started", "tenant" => name, "login" => login)
+
+  listing_started = Process.clock_gettime(Process::CLOCK_MONOTONIC)
+  skipped, queue = largest_first(list_repositories(client, config), state).partition { |repo| (state["skipped"] || []).include?(repo[:full_name]) }
+  run[:listed] = (skipped + queue).map { |repo| repo[:full_name] }
+  queue = enforce_quota(config, run, review_new_repositories(config, run, state, skipped + queue))
+  frozen, queue = queue.partition { |repo| repository_frozen?(config, state, repo[:full_name]) }
+  run[:frozen] = frozen.map { |repo| repo[:full_name] }
+  queue, run[:not_due] = queue.partition { |repo| due_for_update?(config, state, repo) } if config[:smart_schedule]
+  run[:listing] = Process.clock_gettime(Process::CLOCK_MONOTONIC) - listing_started
+  check_workspace(config, queue)
+
+  if config[:canary_repo]
+    passed, queue = run_canary(config, run, client, queue)
+
+    unless passed
+      warning = "Canary #{config[:canary_repo]} failed, not backing up anything else for #{name} until it passes"
+      annotate(config, "error", warning)
+      run[:warnings] << warning
+      queue = []
+    end
+  end
+
+  if config[:collector_budget] > 0 && enabled_collectors(config).any?
+    remaining = client.rate_limit.remaining
+    run[:budget] = CollectorBudget.new(remaining * config[:collector_budget] / 100, enabled_collectors(config).map(&:name))
+  end
+
+  token_expires_at = client && token_expiry(client)
+
+  if token_expires_at && token_expires_at - Time.now.utc < config[:token_expiry_warning_days] * 86400
+    warning = "GitHub token expires at #{token_expires_at.iso8601}"
+    annotate(config, "warning", warning)
+    run[:warnings] << warning
+  end
+
+  export_audit_logs(config, run, client) if config[:export_audit_log] && client
+  export_account(config, client, login) if config[:export_account] && client
+  export_org_integrations(config, client) if config[:export_org_integrations] && client
+
+  {
+    name: name,
+    config: config,
+    run: run,
+    queue: queue,
+    active: 0,
+    deadline: config[:max_run_duration] > 0 ? run[:started_at] + config[:max_run_duration] * 3600 : nil,
+    skipped: []
+  }
+rescue Octokit::Error, Faraday::Error, TokenProviderError, PermissionError, WorkspaceError => e
+  annotate(config, "error", "Backup for #{name} failed: #{e.message}")
+  nil
+end
+
+# With CANARY_REPO set a small repository is backed up before everything else,
+# verified and restored to the workspace. If any of that fails the problem is
+# most likely systemic (credentials, disk, git) and the rest of the run would
+# fail too, so the run stops early with the canary as its failure. Returns
+# whether the canary passed and the rest of the queue.
+def run_canary(config, run, client, queue)
+  repo = queue.find { |candidate| candidate[:full_name].casecmp?(config[:canary_repo]) } || client&.repository(config[:canary_repo])
+  return [false, queue] if repo.nil?
+
+  puts "Backing up the canary #{repo[:full_name]}..."
+
+  restored = backup_repository(config, run, client, repo) ? canary_restore(config, repo[:full_name]) : false
+  passed = restored != false
+  run[:canary] = { "repository" => repo[:full_name], "restore" => { true => "passed", false => "failed", nil => "not checked" }[restored] }
+  run[:repositories] << repo[:full_name]
+
+  if restored.nil?
+    warning = "Canary #{repo[:full_name]} was backed up but its restore wasn't checked, AGE_IDENTITY isn't set"
+    annotate(config, "warning", warning)
+    run[:warnings] << warning
+  end
+  run[:failed] << repo[:full_name] unless passed
+
+  [passed, queue.reject { |candidate| candidate[:full_name] == repo[:full_name] }]
+end
+
+# Whether the canary's backup restores, or nil when it can't be checked
+# because it's encrypted and AGE_IDENTITY isn't set.
+def canary_restore(config, full_name)
+  target = "#{workspace(config)}/canary.git"
+  bundle = "#{target}.bundle"
+  FileUtils.rm_rf(target)
+
+  if config[:age_recipients].any?
+    return nil if config[:age_identity].nil?
+
+    artifact = "#{config[:backup_folder]}/#{artifact_name(stored_name(config, full_name), config[:run_tag])}"
+    execute('age', '-d', '-i', config[:age_identity], '-o', bundle, artifact) &&
+      execute('git', 'clone', '--quiet', '--mirror', bundle, target) &&
+      execute('git', '-C', target, 'fsck', '--no-progress')
+  else
+    path = mirror_path(config, full_name)
+    execute('git', '-C', path, 'fsck', '--full', '--no-progress') &&
+      execute('git', 'clone', '--quiet', '--mirror', '--no-local', path, target) &&
+      execute('git', '-C', target, 'fsck', '--no-progress')
+  end
+ensure
+  FileUtils.rm_rf([target, bundle])
+end
+
+def verification_sample_size(sample, total)
+  return 0 if sample.nil? || sample.empty?
+
+  sample.end_with?("%") ? (total * sample.to_f / 100).ceil : sample.to_i
+end
+
+def verify_sample(config, state, timings)
+  mirrors = mirror_paths(config[:backup_folder])
+  count = verification_sample_size(config[:verify_sample], mirrors.size)
+  return if count.zero?
+
+  verified = state["verified"] ||= {}
+
+  mirrors.sort_by { |full_name, _| verified.dig(full_name, "at") || "" }.first(count).each do |full_name, path|
+    puts "Verifying #{full_name}..."
+
+    ok = timed(timings[full_name] ||= {}, "verification", full_name) { execute('git', '-C', path, 'fsck', '--no-progress') }
+    annotate(config, "error", "Verification failed for #{full_name}") unless ok
+
+    verified[full_name] = { "at" => Time.now.utc.iso8601, "ok" => ok }
+  end
+end
+
+def percentile(values, percent)
+  sorted = values.sort
+  sorted[((sorted.size - 1) * percent / 100.0).round]
+end
+
+def annotate(config, level, message)
+  emit(level, "message" => message)
+
+  if config[:output] == "gha"
+    puts "::#{level}::#{message.gsub("%", "%25").gsub("\r", "%0D").gsub("\n", "%0A")}"
+  elsif level == "warning"
+    puts "WARNING: #{message}"
+  else
+    puts message
+  end
+end
+
+def activity_summary(branches)
+  branches.map { |branch, change| change["deleted"] ? "#{branch} deleted" : "#{branch} +#{change["commits"]}" }.join(", ")
+end
+
+def write_job_summary(name, run)
+  path = ENV["GITHUB_STEP_SUMMARY"]
+  return if path.nil? || path.empty?
+
+  failures = run[:state]["last_run"]["failures"]
+  rows = run[:failed].sort.map { |full_name| "| #{full_name} | failed (#{failures[full_name]}) | |" }
+  rows += run[:activity].sort.map { |full_name, branches| "| #{full_name} | updated | #{activity_summary(branches)} |" }
+
+  File.open(path, "a") do |file|
+    file.puts "### Backup of #{name}"
+    file.puts
+    file.puts "#{run[:repositories].size} repositories, #{run[:failed].size} failed, #{run[:activity].size} updated"
+    file.puts
+
+    if rows.any?
+      file.puts "| Repository | Result | Branches |"
+      file.puts "| --- | --- | --- |"
+      rows.each { |row| file.puts row }
+      file.puts
+    end
+  end
+end
+
+# The config keys of SECRET_SETTINGS, GITHUB_TOKEN is the only setting whose
+# key isn't its name in lower case.
+SECRET_CONFIG = SECRET_SETTINGS.map { |name| name == "GITHUB_TOKEN" ? :github_secret : name.downcase.to_sym }
+
+def command_version(*command)
+  output, status = Open3.capture2(*command, err: File::NULL)
+  status.success? ? output.strip : nil
+rescue SystemCallError
+  nil
+end
+
+def disk_stats(path)
+  output = command_version('df', '-Pk', path)
+  return nil if output.nil?
+
+  total, used, available = output.lines.last.split[1, 3].map { |blocks| blocks.to_i * 1024 }
+  { "total" => total, "used" => used, "available" => available }
+end
+
+def run_environment(config)
+  uname = Etc.uname
+
+  {
+    "ghbackup" => [VERSION, REVISION, BUILD_DATE].reject { |detail| detail.nil? || detail.empty? }.join(" "),
+    "git" => command_version('git', '--version'),
+    "git_lfs" => command_version('git', 'lfs', 'version'),
+    "age" => command_version('age', '--version'),
+    "ruby" => RUBY_VERSION,
+    "octokit" => Octokit::VERSION,
+    "platform" => "#{uname[:sysname]} #{uname[:release]} #{uname[:machine]}",
+    "hostname" => Socket.gethostname,
+    "disk" => disk_stats(config[:backup_folder]),
+    "config" => config.map { |key, value| [key, SECRET_CONFIG.include?(key) && value ? "REDACTED" : value] }.to_h
+  }
+end
+
+# Notifiers deliver a message about each run. Third parties can add their own
+# by registering them from a file listed in NOTIFIER_PLUGINS:
+#
+#   register_notifier("example") do |config, subject, body, report|
+#     ...
+#   end
+Notifier = Struct.new(:name, :deliver)
+NOTIFIERS = {}
+
+DEFAULT_SUBJECT_TEMPLATE = <<~ERB.chomp
+  ghbackup <%= report["tenant"] %>: <% if report["failed"].empty? %>backed up <%= report["repositories"] %> repositories<% else %><%= report["failed"].size %> of <%= report["repositories"] %> repositories failed<% end %>
+ERB
+
+DEFAULT_BODY_TEMPLATE = <<~ERB
+  Run started at <%= report["started_at"] %> and finished at <%= report["finished_at"] %>.
+  <% report["failures"].each do |full_name, category| -%>
+  Failed: <%= full_name %> (<%= category %>)
+  <% end -%>
+  <% report["warnings"].each do |warning| -%>
+  Warning: <%= warning %>
+  <% end -%>
+ERB
+
+def register_notifier(name, &deliver)
+  NOTIFIERS[name] = Notifier.new(name, deliver)
+end
+
+register_notifier("webhook") do |config, subject, body, report|
+  uri = URI(config[:notify_webhook_url] || raise(ConfigError, "NOTIFY_WEBHOOK_URL isn't set"))
+  request = Net::HTTP::Post.new(uri, "Content-Type" => "application/json", "User-Agent" => user_agent(config))
+  request.body = JSON.generate("subject" => subject, "body" => body, "report" => report)
+
+  response = Net::HTTP.start(uri.host, uri.port, use_ssl: uri.scheme == "https", open_timeout: 10, read_timeout: 30) { |http| http.request(request) }
+  raise "#{uri.host} responded with #{response.code}" unless response.is_a?(Net::HTTPSuccess)
+end
+
+register_notifier("command") do |config, subject, body, _|
+  command = config[:notify_command] || raise(ConfigError, "NOTIFY_COMMAND isn't set")
+  _, status = Open3.capture2e({ "GHBACKUP_SUBJECT" => subject }, 'sh', '-c', command, stdin_data: body)
+  raise "#{command} exited with #{status.exitstatus}" unless status.success?
+end
+
+# Renders a notifier's subject and body from the run report. Templates are ERB
+# files named <notifier>.subject.erb and <notifier>.body.erb in
+# NOTIFY_TEMPLATES, falling back to the built in templates.
+def render_notification(config, notifier, report)
+  %w[subject body].map do |part|
+    path = config[:notify_templates] && "#{config[:notify_templates]}/#{notifier}.#{part}.erb"
+    template = path && File.exist?(path) ? File.read(path) : (part == "subject" ? DEFAULT_SUBJECT_TEMPLATE : DEFAULT_BODY_TEMPLATE)
+
+    ERB.new(template, trim_mode: "-").result_with_hash(report: report)
+  end
+end
+
+def notify(config, report)
+  return if config[:notify_on] == "failures" && report["failed"].empty? && report["warnings"].empty?
+
+  config[:notify].each do |name|
+    subject, body = render_notification(config, name, report)
+    NOTIFIERS[name].deliver.call(config, subject, body, report)
+  rescue StandardError => e
+    annotate(config, "warning", "Unable to notify #{name}: #{e.message}")
+  end
+end
+
+def write_report(name, config, run)
+  phases = run[:timings].values.flat_map(&:keys).uniq
+
+  aggregates = phases.map do |phase|
+    durations = run[:timings].values.map { |timings| timings[phase] }.compact
+
+    [phase, {
+      "total" => durations.sum.round(2),
+      "p50" => percentile(durations, 50).round(2),
+      "p90" => percentile(durations, 90).round(2),
+      "p99" => percentile(durations, 99).round(2),
+      "max" => durations.max.round(2)
+    }]
+  end.to_h
+
+  report = run[:state]["last_run"].merge(
+    "tenant" => name,
+    "listing" => run[:listing].round(2),
+    "skipped_repositories" => run[:state]["skipped"],
+    "phases" => aggregates,
+    "activity" => run[:activity],
+    "errors" => run[:errors],
+    "collectors" => collector_report(run),
+    "environment" => run_environment(config),
+    "timings" => run[:timings].transform_values { |timings| timings.transform_values { |duration| duration.round(2) } }
+  )
+
+  write_json("#{config[:backup_folder]}/.ghbackup/reports/#{run[:started_at].strftime("%Y%m%dT%H%M%SZ")}.json", report)
+  emit("run_finished", report.reject { |key, _| key == "timings" })
+  notify(config, report)
+
+  puts "Run summary for #{name}, listing took #{report["listing"]}s"
+  puts "  #{"phase".ljust(14)}#{%w[total p50 p90 p99 max].map { |column| column.rjust(10) }.join}"
+
+  aggregates.each do |phase, aggregate|
+    puts "  #{phase.ljust(14)}#{aggregate.values.map { |value| "#{value}s".rjust(10) }.join}"
+  end
+
+  puts "Failures for #{name}: #{failure_summary(report["failures"])}" if report["failures"].any?
+  puts "Activity for #{name}" if run[:activity].any?
+
+  run[:activity].sort.each do |full_name, branches|
+    puts "  #{full_name}: #{activity_summary(branches)}"
+
+    branches.each_value do |change|
+      (change["log"] || []).each { |line| puts "    #{line}" }
+    end
+  end
+
+  return unless config[:output] == "gha"
+
+  run[:failed].sort.each { |full_name| annotate(config, "error", "Backup of #{full_name} failed") }
+  annotate(config, "notice", "Backed up #{run[:repositories].size} repositories for #{name}, #{run[:failed].size} failed, #{run[:activity].size} updated")
+  write_job_summary(name, run)
+end
+
+def prune_history(config, state)
+  runs = state["runs"] || []
+
+  if config[:run_history_days] > 0
+    cutoff = Time.now.utc - config[:run_history_days] * 86400
+    runs = runs.select { |run| Time.parse(run["started_at"]) >= cutoff }
+  end
+
+  runs = runs.last(config[:run_history]) if config[:run_history] > 0
+  state["runs"] = runs
+
+  return if runs.empty?
+
+  oldest = Time.parse(runs.first["started_at"]).utc.strftime("%Y%m%dT%H%M%SZ")
+
+  Dir.glob("#{config[:backup_folder]}/.ghbackup/{reports/*.json,transcripts/*.sh}").each do |file|
+    FileUtils.rm_f(file) if File.basename(file, ".*") < oldest
+  end
+end
+
+# Copies a file tree the way rsync --link-dest does, files that are unchanged
+# since the previous copy (same size and modification time) are hard linked
+# to it rather than copied.
+def link_copy(source, target, previous)
+  Find.find(source) do |path|
+    relative = path.delete_prefix(source)
+    destination = "#{target}#{relative}"
+    stat = File.lstat(path)
+
+    if stat.directory?
+      FileUtils.mkdir_p(destination)
+      next
+    end
+
+    earlier = "#{previous}#{relative}" if previous
+
+    if earlier && File.file?(earlier) && File.size(earlier) == stat.size && File.mtime(earlier) == stat.mtime
+      File.link(earlier, destination)
+    else
+      FileUtils.cp(path, destination, preserve: true)
+    end
+  end
+end
+
+# With KEEP_PREVIOUS=true each mirror is copied to <repo>.git.prev before it's
+# updated, so if an update replicates damage from upstream the backup from the
+# run before is still there. Objects are hard linked as git never changes them
+# in place, everything else is copied.
+def rotate_previous(path)
+  previous = "#{path}.prev"
+  FileUtils.rm_rf("#{previous}.tmp")
+
+  Find.find(path) do |file|
+    relative = file.delete_prefix(path)
+    destination = "#{previous}.tmp#{relative}"
+
+    if File.lstat(file).directory?
+      FileUtils.mkdir_p(destination)
+    elsif relative.start_with?("/objects/")
+      File.link(file, destination)
+    else
+      FileUtils.cp(file, destination, preserve: true)
+    end
+  end
+
+  FileUtils.rm_rf(previous)
+  File.rename("#{previous}.tmp", previous)
+end
+
+# With LINKED_SNAPSHOTS set, every run ends with a dated copy of all mirrors in
+# _snapshots/<timestamp>, hard linked to the previous snapshot wherever the
+# mirror hasn't changed, keeping that many of the latest snapshots.
+def take_linked_snapshot(config, run)
+  root = "#{config[:backup_folder]}/_snapshots"
+  FileUtils.rm_rf(Dir.glob("#{root}/*.tmp"))
+  previous = Dir.glob("#{root}/*").max
+  target = "#{root}/#{run[:started_at].strftime("%Y%m%dT%H%M%SZ")}"
+
+  mirror_paths(config[:backup_folder]).each do |_, path|
+    relative = path.delete_prefix(config[:backup_folder])
+    link_copy(path, "#{target}.tmp#{relative}", previous && "#{previous}#{relative}")
+  end
+
+  File.rename("#{target}.tmp", target) if Dir.exist?("#{target}.tmp")
+  Dir.glob("#{root}/*").reject { |snapshot| snapshot.end_with?(".tmp") }.sort[0...-config[:linked_snapshots]].each { |snapshot| FileUtils.rm_rf(snapshot) }
+rescue SystemCallError => e
+  FileUtils.rm_rf("#{target}.tmp")
+  warning = "Unable to take a linked snapshot: #{e.message}"
+  annotate(config, "warning", warning)
+  run[:warnings] << warning
+end
+
+# Takes a ZFS or Btrfs snapshot of the backup folder (FS_SNAPSHOT), keeping the
+# latest FS_SNAPSHOT_KEEP, or runs SNAPSHOT_CMD with {name} and {path} filled
+# in. Only called after a run in which every repository was backed up, so a
+# snapshot never captures a half updated backup.
+def take_fs_snapshot(config, run)
+  name = "ghbackup-#{run[:started_at].strftime("%Y%m%dT%H%M%SZ")}"
+
+  taken = case config[:fs_snapshot]
+  when "zfs"
+    dataset = config[:fs_snapshot_target]
+
+    execute('zfs', 'snapshot', "#{dataset}@#{name}").tap do |success|
+      next unless success
+
+      output, _ = Open3.capture2('zfs', 'list', '-H', '-t', 'snapshot', '-o', 'name', '-s', 'creation', '-d', '1', dataset)
+      snapshots = output.lines.map(&:strip).select { |snapshot| snapshot.start_with?("#{dataset}@ghbackup-") }
+      snapshots[0...-config[:fs_snapshot_keep]].each { |snapshot| execute('zfs', 'destroy', snapshot) }
+    end
+  when "btrfs"
+    directory = config[:fs_snapshot_target]
+
+    execute('btrfs', 'subvolume', 'snapshot', '-r', config[:backup_folder], "#{directory}/#{name}").tap do |success|
+      next unless success
+
+      Dir.glob("#{directory}/ghbackup-*").sort[0...-config[:fs_snapshot_keep]].each { |snapshot| execute('btrfs', 'subvolume', 'delete', snapshot) }
+    end
+  else
+    execute('sh', '-c', config[:snapshot_cmd].gsub("{name}", name).gsub("{path}", config[:backup_folder]))
+  end
+
+  if taken
+    puts "Took filesystem snapshot #{name}"
+  else
+    annotate(config, "error", "Taking filesystem snapshot #{name} failed")
+  end
+end
+
+def finish_tenant(tenant)
+  config = tenant[:config]
+  run = tenant[:run]
+  Thread.current[:transcript] = [run[:transcript], nil]
+
+  if config[:export_dir]
+    write_export_manifest(config[:export_dir], run[:started_at], config[:run_tag], run[:exports])
+  end
+
+  pending = mark_orphans(config, run[:state], run[:listed])
+
+  durations = run[:state]["durations"] ||= {}
+  run[:timings].each { |full_name, timings| durations[full_name] = timings.values.sum.round(2) }
+
+  verify_sample(config, run[:state], run[:timings])
+
+  if config[:deep_verify_interval] > 0 && deep_verify_due?(config, run[:state])
+    client = build_client(config) unless config[:source_dir]
+
+    deep_verify(config, run[:state], client, run[:login]).each do |problem|
+      warning = "Deep verification failed for #{problem}"
+      annotate(config, "error", warning)
+      run[:warnings] << warning
+    end
+  end
+  take_linked_snapshot(config, run) if config[:linked_snapshots] > 0 && config[:age_recipients].empty?
+
+  if tenant[:skipped].any?
+    warning = "#{tenant[:stopped]}, #{tenant[:skipped].size} repositories skipped until the next run"
+    annotate(config, "warning", warning)
+    run[:warnings] << warning
+  end
+
+  if run[:deferred].any?
+    warning = "Collector budget used up, deferred to the next run: #{run[:deferred].map { |collector, names| "#{collector} for #{names.size} repositories" }.join(", ")}"
+    annotate(config, "warning", warning)
+    run[:warnings] << warning
+  end
+
+  run[:state]["deferred_collectors"] = run[:deferred]
+  run[:state]["coverage"] = { "listed" => run[:listed], "backed_up" => (run[:repositories] - run[:failed]).sort }
+  run[:state]["skipped"] = tenant[:skipped]
+  run[:state]["last_run"] = {
+    "started_at" => run[:started_at].iso8601,
+    "finished_at" => Time.now.utc.iso8601,
+    "run_tag" => config[:run_tag],
+    "repositories" => run[:repositories].size,
+    "failed" => run[:failed].sort,
+    "failures" => run[:failed].sort.map { |full_name| [full_name, classify_error(run[:errors][full_name] || [])] }.to_h,
+    "skipped" => tenant[:skipped].size,
+    "stopped" => tenant[:stopped],
+    "canary" => run[:canary],
+    "usage" => run[:usage].to_h,
+    "transcript" => (run[:transcript].path.delete_prefix("#{config[:backup_folder]}/") if run[:transcript]&.written?),
+    "not_due" => run[:not_due].size,
+    "limited" => run[:limited],
+    "new_repositories" => run[:new_repositories],
+    "frozen" => run[:frozen],
+    "pending_deletion" => pending.keys.sort,
+    "warnings" => run[:warnings]
+  }
+  (run[:state]["runs"] ||= []) << run[:state]["last_run"]
+  prune_history(config, run[:state])
+  save_state(config[:backup_folder], run[:state])
+
+  if config[:fs_snapshot] || config[:snapshot_cmd]
+    if run[:failed].empty? && tenant[:skipped].empty? && run[:limited].empty?
+      take_fs_snapshot(config, run)
+    else
+      puts "Not taking a filesystem snapshot, the run didn't fully succeed"
+    end
+  end
+
+  write_report(tenant[:name], config, run)
+ensure
+  Thread.current[:transcript] = nil
+  run[:transcript]&.close
+end
+
+CREDENTIAL_ERRORS = /Authentication failed|could not read Username|Invalid username or password|Bad credentials|returned error: 401/
+
+# Failures are put in the first category whose pattern matches the output of
+# the repository's commands, so reports can say "3 auth, 1 disk full" rather
+# than listing exit statuses.
+ERROR_CATEGORIES = {
+  "auth" => Regexp.union(CREDENTIAL_ERRORS, /returned error: 403/),
+  "not found" => /Repository not found|returned error: 404|does not appear to be a git repository/,
+  "disk full" => /No space left on device|Disk quota exceeded/,
+  "LFS quota" => /over its data quota|LFS budget/,
+  "early EOF" => /early EOF|unexpected disconnect|the remote end hung up unexpectedly|RPC failed|transfer closed with outstanding read data/,
+  "ref negotiation" => /negotiation|protocol error|did not send all necessary objects/
+}
+
+THROTTLE_ERRORS = /returned error: 429|rate limit|abuse detection/i
+
+# How a repository's backup counts towards the worker concurrency, see
+# ConcurrencyController.
+def concurrency_outcome(config, run, full_name, success)
+  return :success if success
+
+  run[:mutex].synchronize do
+    return :skipped if run[:limited].key?(full_name)
+    return :skipped if config[:shrink_protection] && (run[:state]["shrinkage"] || {}).key?(full_name)
+
+    errors = run[:errors][full_name] || []
+    return :throttled if errors.any? { |line| line.match?(THROTTLE_ERRORS) }
+
+    classify_error(errors) == "early EOF" ? :transient : :failed
+  end
+end
+
+def classify_error(lines)
+  ERROR_CATEGORIES.find { |_, pattern| lines.any? { |line| line.match?(pattern) } }&.first || "other"
+end
+
+def failure_summary(failures)
+  failures.values.tally.sort_by { |category, count| [-count, category] }.map { |category, count| "#{count} #{category}" }.join(", ")
+end
+
+def refresh_token(tenant, stale)
+  tenant[:run][:mutex].synchronize do
+    tenant[:config] = resolve_token(tenant[:config]) if tenant[:config][:github_secret] == stale
+    tenant[:config][:github_secret] != stale
+  end
+end
+
+# Backs up a repository and, when it fails because the token was rejected
+# (e.g. it expired part way through a long run), fetches a new token from the
+# token provider and tries once more. Clients are cached per token so the
+# other workers pick up the new token too.
+def backup_with_reauth(tenant, clients, repo)
+  secret = tenant[:config][:github_secret]
+  unauthorized = false
+
+  attempt = lambda do
+    client = clients[[tenant[:name], tenant[:config][:github_secret]]] ||= build_client(tenant[:config])
+    Thread.current[:usage] = tenant[:run][:usage]
+    Thread.current[:transcript] = [tenant[:run][:transcript], repo[:full_name]]
+    backup_repository(tenant[:config], tenant[:run], client, repo)
+  rescue Octokit::Unauthorized
+    unauthorized = true
+    false
+  end
+
+  return true if attempt.call
+
+  errors = tenant[:run][:mutex].synchronize { tenant[:run][:errors][repo[:full_name]] || [] }
+  return false unless unauthorized || errors.any? { |line| line.match?(CREDENTIAL_ERRORS) }
+  return false unless refresh_token(tenant, secret)
+
+  puts "Retrying #{repo[:full_name]} with a refreshed token..."
+  attempt.call
+rescue TokenProviderError => e
+  annotate(tenant[:config], "error", "Refreshing the token for #{tenant[:name]} failed: #{e.message}")
+  false
+end
+
+GITHUB_STATUS_URL = "https://www.githubstatus.com/api/v2/components.json"
+GITHUB_STATUS_COMPONENTS = ["Git Operations", "API Requests"]
+
+def github_degraded(config)
+  uri = URI(GITHUB_STATUS_URL)
+  response = Net::HTTP.start(uri.host, uri.port, use_ssl: true, open_timeout: 10, read_timeout: 10) do |http|
+    http.get(uri.path, "User-Agent" => user_agent(config))
+  end
+  return [] unless response.is_a?(Net::HTTPSuccess)
+
+  components = JSON.parse(response.body)["components"].select { |component| GITHUB_STATUS_COMPONENTS.include?(component["name"]) }
+  components.reject { |component| component["status"] == "operational" }.map { |component| "#{component["name"]} #{component["status"].tr("_", " ")}" }
+rescue SystemCallError, SocketError, Timeout::Error, OpenSSL::SSL::SSLError, JSON::ParserError
+  []
+end
+
+# With CHECK_GITHUB_STATUS=true a run waits while githubstatus.com reports git
+# operations or the API as degraded, retrying with jittered backoff for up to
+# GITHUB_STATUS_MAX_DELAY minutes, rather than every repository failing during
+# an incident. Returns a note for the run report if there was an incident.
+def wait_for_github(config)
+  started = Time.now
+  deadline = started + config[:github_status_max_delay] * 60
+  delay = 60
+  incident = nil
+
+  loop do
+    degraded = github_degraded(config)
+
+    if degraded.empty?
+      return incident && "Waited #{((Time.now - started) / 60).round} minutes for a GitHub incident to clear: #{incident}"
+    end
+
+    incident = degraded.join(", ")
+    return "GitHub reported #{incident}, ran anyway after waiting #{config[:github_status_max_delay].round} minutes" if Time.now >= deadline
+
+    puts "GitHub reports #{incident}, waiting before starting..."
+    sleep [[delay * (0.5 + rand), deadline - Time.now].min, 1].max
+    delay = [delay * 2, 600].min
+  end
+end
+
+def backup(tenants = load_tenants, wait: false)
+  paused = false
+  Signal.trap("USR1") { paused = true }
+  Signal.trap("USR2") { paused = false }
+
+  with_lock(wait: wait) do
+    Octokit.configure do |c|
+      c.auto_paginate = true
+    end
+
+    workers = load_config[:workers]
+
+    tenants.map { |_, config| config }.uniq { |config| config[:work_dir] }.each do |config|
+      stale_workspaces(config).each { |path| FileUtils.rm_rf(path) }
+    end
+
+    incident = wait_for_github(load_config) if load_config[:check_github_status]
+    annotate(load_config, "warning", incident) if incident
+
+    tenants = tenants.map { |name, config| prepare_tenant(name, config) }.compact
+    tenants.each { |tenant| tenant[:run][:warnings] << incident } if incident
+
+    scheduler = TenantScheduler.new(tenants)
+    controller = ConcurrencyController.new(workers)
+
+    threads = workers.times.map do
+      Thread.new do
+        clients = {}
+
+        loop do
+          if paused
+            puts "Paused, waiting to resume..."
+            sleep 10 while paused
+            puts "Resuming..."
+          end
+
+          item = scheduler.next_item
+          break if item.nil?
+
+          if item == :wait
+            sleep 10
+            next
+          end
+
+          tenant, repo = item
+          run = tenant[:run]
+
+          controller.acquire
+          success = false
+          throttled = false
+
+          begin
+            success = backup_with_reauth(tenant, clients, repo)
+          rescue *RATE_LIMIT_ERRORS => e
+            throttled = true
+            annotate(tenant[:config], "warning", "Rate limited while backing up #{repo[:full_name]}: #{e.message}")
+          ensure
+            controller.release(throttled ? :throttled : concurrency_outcome(tenant[:config], run, repo[:full_name], success))
+            scheduler.finished(tenant)
+
+            run[:mutex].synchronize do
+              run[:repositories] << repo[:full_name]
+              run[:failed] << repo[:full_name] unless success || run[:limited].key?(repo[:full_name])
+            end
+          end
+        end
+      end
+    end
+
+    threads.each(&:join)
+    tenants.each { |tenant| finish_tenant(tenant) }
+    publish_host_status(load_config) if load_config[:host_status_dir] || load_config[:host_status_url]
+  end
+end
+
+EVENT_TYPES = %w[PushEvent CreateEvent DeleteEvent]
+
+# Events newest first, following the pages back until the event after the
+# cursor, or as far as GitHub goes (300 events), so bursts between polls
+# aren't cut short.
+def recent_events(client, method, *args, cursor: nil)
+  client.auto_paginate = false
+  events = client.public_send(method, *args, per_page: 100)
+  page = client.last_response
+
+  while cursor && events.any? && events.last[:id].to_i > cursor.to_i && page.rels[:next]
+    page = page.rels[:next].get
+    events += page.data
+  end
+
+  events
+ensure
+  client.auto_paginate = true
+end
+
+def backup_by_name(config, client, state, login, full_names)
+  run = new_run(login, state, config)
+  previous_transcript = Thread.current[:transcript]
+  previous_usage = Thread.current[:usage]
+  Thread.current[:usage] = run[:usage]
+
+  full_names.each_with_index do |full_name, index|
+    Thread.current[:transcript] = [run[:transcript], full_name]
+
+    if (stopped = budget_exhausted(config, run[:usage]))
+      skipped = full_names.drop(index)
+      state["skipped"] = (state["skipped"] || []) | skipped
+      annotate(config, "warning", "#{stopped}, #{skipped.size} repositories skipped until the next run")
+      break
+    end
+
+    if repository_frozen?(config, state, full_name)
+      puts "Skipping #{full_name}, it's frozen..."
+      next
+    end
+
+    if config[:new_repositories] == "approve" && state["seen"] && !state["seen"].key?(full_name)
+      puts "Skipping #{full_name}, it hasn't been approved with ghbackup approve..."
+      next
+    end
+
+    begin
+      repo = client.repository(full_name)
+    rescue Octokit::NotFound
+      puts "Skipping #{full_name}, no longer accessible..."
+      next
+    end
+
+    run[:failed] << full_name unless backup_repository(config, run, client, repo) || run[:limited].key?(full_name)
+  end
+
+  if config[:export_dir] && run[:exports].any?
+    write_export_manifest(config[:export_dir], run[:started_at], config[:run_tag], run[:exports])
+  end
+
+  run[:failed]
+ensure
+  Thread.current[:transcript] = previous_transcript
+  Thread.current[:usage] = previous_usage
+  run[:transcript]&.close
+end
+
+def backup_single(full_name)
+  with_lock do
+    Octokit.configure do |c|
+      c.auto_paginate = true
+    end
+
+    load_tenants.each do |name, config|
+      check_permissions(config)
+      config = resolve_token(config)
+      client = build_client(config)
+
+      begin
+        client.repository(full_name)
+      rescue Octokit::NotFound
+        next
+      end
+
+      state = load_state(config[:backup_folder])
+      failed = backup_by_name(config, client, state, cached_login(client, config, state), [full_name])
+      save_state(config[:backup_folder], state)
+
+      abort "Backup of #{full_name} failed" if failed.any?
+      return
+    end
+
+    abort "#{full_name} isn't visible to any tenant"
+  end
+rescue Octokit::Error, Faraday::Error, TokenProviderError, PermissionError => e
+  abort "Backup of #{full_name} failed: #{e.message}"
+end
+
+def poll_events(name, config)
+  state = load_state(config[:backup_folder])
+  config = resolve_token(config)
+  client = build_client(config)
+  login = cached_login(client, config, state)
+
+  sources = [["user", :user_events, login]]
+  sources += client.organizations.map { |org| ["org:#{org[:login]}", :organization_events, org[:login]] }
+
+  cursors = state["event_cursors"] ||= {}
+  full_names = []
+  poll_interval = config[:events_interval]
+
+  sources.each do |source, method, argument|
+    events = recent_events(client, method, argument, cursor: cursors[source])
+    poll_interval = [poll_interval, client.last_response.headers["x-poll-interval"].to_i].max
+    next if events.empty?
+
+    if cursors[source]
+      full_names += events.select { |event| event[:id].to_i > cursors[source].to_i && EVENT_TYPES.include?(event[:type]) }.map { |event| event[:repo][:name] }
+    end
+
+    cursors[source] = events.map { |event| event[:id].to_i }.max.to_s
+  end
+
+  full_names = full_names.uniq.select { |full_name| selected?(config, full_name) }
+  backup_by_name(config, client, state, login, full_names).each { |full_name| puts "Backup of #{full_name} failed" }
+
+  save_state(config[:backup_folder], state)
+  poll_interval
+rescue Octokit::Error, Faraday::Error, TokenProviderError => e
+  puts "Polling events for #{name} failed: #{e.message}"
+  nil
+end
+
+def watch_events
+  tenants = load_tenants
+
+  reload = false
+  Signal.trap("HUP") { reload = true }
+
+  # Polling before the first full run records where the events start, so
+  # pushes made while it runs are fetched by the next poll.
+  with_lock(wait: true) do
+    tenants.each { |name, config| poll_events(name, config) }
+  end
+
+  backup(tenants, wait: true)
+
+  loop do
+    interval = with_lock(wait: true) do
+      tenants.map { |name, config| poll_events(name, config) }.compact.max
+    end
+
+    deadline = Time.now + (interval || tenants.map { |_, config| config[:events_interval] }.max)
+    sleep 1 until reload || Time.now >= deadline
+    reload = false
+
+    tenants = reload_tenants(tenants)
+
+    due = tenants.any? do |_, config|
+      config[:backup_interval] > 0 && due?(config, load_state(config[:backup_folder]))
+    end
+
+    backup(tenants, wait: true) if due
+  end
+end
+
+# Each host publishes the outcome of its last runs, either to a folder shared
+# between the hosts or to the ghbackup serve of the host collecting them, so
+# status --all-hosts can show every host and the repositories none of them
+# backed up.
+def host_status
+  tenants = load_tenants.map do |name, config|
+    state = load_state(config[:backup_folder])
+    [name, { "last_run" => state["last_run"], "coverage" => state["coverage"] }]
+  end
+
+  { "host" => load_config[:host_name], "published_at" => Time.now.utc.iso8601, "tenants" => tenants.to_h }
+end
+
+def host_status_authorized?(config, authorization)
+  return false if config[:host_status_token].to_s.empty?
+
+  # Digests are compared so the time taken doesn't give the token away
+  Digest::SHA256.digest(authorization.to_s) == Digest::SHA256.digest("Bearer #{config[:host_status_token]}")
+end
+
+def publish_host_status(config)
+  status = host_status
+  write_json("#{config[:host_status_dir]}/#{config[:host_name]}.json", status) if config[:host_status_dir]
+  return if config[:host_status_url].nil?
+
+  uri = URI(config[:host_status_url])
+  request = Net::HTTP::Post.new(uri, "Content-Type" => "application/json", "Authorization" => "Bearer #{config[:host_status_token]}")
+  request.body = JSON.generate(status)
+
+  response = Net::HTTP.start(uri.host, uri.port, use_ssl: uri.scheme == "https", open_timeout: 10, read_timeout: 30) { |http| http.request(request) }
+  annotate(config, "warning", "Unable to publish the host status to #{uri.host}: #{response.code}") unless response.is_a?(Net::HTTPSuccess)
+rescue SystemCallError, SocketError, Timeout::Error, OpenSSL::SSL::SSLError => e
+  annotate(config, "warning", "Unable to publish the host status: #{e.message}")
+end
+
+def all_hosts_status
+  config = load_config
+  abort "HOST_STATUS_DIR isn't set" if config[:host_status_dir].nil?
+
+  listed = []
+  backed_up = []
+
+  Dir.glob("#{config[:host_status_dir]}/*.json").sort.each do |path|
+    status = JSON.parse(File.read(path))
+    puts "#{status["host"]}: published #{status["published_at"]}"
+
+    status["tenants"].each do |name, tenant|
+      last_run = tenant["last_run"]
+      puts last_run ? "  #{name}: last run #{last_run["started_at"]}, #{last_run["repositories"]} repositories, #{last_run["failed"].size} failed" : "  #{name}: never run"
+
+      listed |= tenant.dig("coverage", "listed") || []
+      backed_up |= tenant.dig("coverage", "backed_up") || []
+    end
+  end
+
+  (listed - backed_up).sort.each { |full_name| puts "not covered by any host: #{full_name}" }
+end
+
+def status(options)
+  return list_runs(nil) if options.include?("--history")
+  return all_hosts_status if options.include?("--all-hosts")
+
+  load_tenants.each do |name, config|
+    state = load_state(config[:backup_folder])
+    last_run = state["last_run"]
+
+    if last_run.nil?
+      puts "#{name}: never run"
+    else
+      puts "#{name}: last run #{last_run["started_at"]}#{" (#{last_run["run_tag"]})" if last_run["run_tag"]}, #{last_run["repositories"]} repositories, #{last_run["failed"].size} failed#{", #{last_run["not_due"]} not due" if last_run["not_due"].to_i > 0}"
+      last_run["failed"].each { |full_name| puts "  failed: #{full_name}#{" (#{last_run["failures"][full_name]})" if last_run["failures"]}" }
+      (last_run["limited"] || {}).each { |full_name, reason| puts "  exceeded limits: #{full_name} (#{reason})" }
+      (last_run["new_repositories"] || []).each { |full_name| puts "  new: #{full_name}" }
+      (last_run["warnings"] || []).each { |warning| puts "  warning: #{warning}" }
+    end
+
+    (state["verified"] || {}).each do |full_name, verification|
+      puts "  verification failed: #{full_name} (#{verification["at"]})" unless verification["ok"]
+    end
+
+    (state["frozen"] || {}).each do |full_name, frozen|
+      puts "  frozen: #{full_name} (since #{frozen["at"]}#{", #{frozen["reason"]}" if frozen["reason"]})"
+    end
+
+    (state["pending_approval"] || {}).each do |full_name, since|
+      puts "  waiting for approval: #{full_name} (since #{since})"
+    end
+
+    (state["pending_deletion"] || {}).each do |full_name, pending|
+      puts "  pending deletion: #{full_name} (missing since #{pending["since"]}, #{pending["runs"]} runs)"
+    end
+
+    (state["shrinkage"] || {}).each do |full_name, shrinkage|
+      puts "  shrinkage: #{full_name} (#{shrinkage["at"]}), #{shrinkage["reason"]}"
+    end
+
+    (state["transfers"] || {}).each do |full_name, transfer|
+      puts "  transferred: #{full_name} to #{transfer["to"]} (#{transfer["at"]})"
+    end
+  end
+end
+
+# Predicts what the next run of each tenant would do from the state of the
+# previous runs alone, without listing repositories or running git. New
+# repositories and changes on GitHub since the last run can't be known so the
+# estimates only cover the repositories that have been backed up before.
+def simulate
+  load_tenants.each do |name, config|
+    state = load_state(config[:backup_folder])
+    durations = state["durations"] || {}
+    fetched = state["fetched"] || {}
+
+    known = (mirror_paths(config[:backup_folder]).map(&:first) | durations.keys).select { |full_name| selected?(config, full_name) }
+    skipped, known = known.partition { |full_name| (state["skipped"] || []).include?(full_name) }
+    frozen, queue = (skipped + known.sort_by { |full_name| -(durations[full_name] || 0) }).partition { |full_name| repository_frozen?(config, state, full_name) }
+    pending, queue = queue.partition { |full_name| (state["pending_approval"] || {}).key?(full_name) }
+    queue, not_due = queue.partition { |full_name| due_for_update?(config, state, { full_name: full_name }) } if config[:smart_schedule]
+
+    # Repositories are handed to the first free worker in queue order.
+    workers = Array.new(config[:workers], 0.0)
+    scheduled = queue.map do |full_name|
+      start = workers.min
+      finish = workers[workers.index(start)] = start + (durations[full_name] || 0)
+      [full_name, start, finish]
+    end
+
+    if config[:max_run_duration] > 0
+      late, scheduled = scheduled.partition { |_, start, _| start >= config[:max_run_duration] * 3600 }
+    end
+
+    updates = scheduled.map(&:first)
+    duration = scheduled.map(&:last).max || 0
+    volume = updates.sum { |full_name| fetched[full_name] ? fetched[full_name].sum / fetched[full_name].size : 0 }
+    unknown = updates.count { |full_name| durations[full_name].nil? }
+
+    puts "#{name}: #{due?(config, state) ? "due now" : "not due yet, BACKUP_INTERVAL is #{config[:backup_interval]} hours"}"
+    puts "  #{updates.size} repositories would be updated#{", #{unknown} never timed" if unknown > 0}"
+    puts "  #{not_due.size} not due under SMART_SCHEDULE" if not_due
+    puts "  #{frozen.size} frozen" if frozen.any?
+    puts "  #{pending.size} waiting for approval" if pending.any?
+    puts "  #{late.size} skipped until the following run, MAX_RUN_DURATION is #{config[:max_run_duration]} hours" if late&.any?
+    puts "  estimated duration #{(duration / 60).ceil} minutes with #{config[:workers]} workers"
+    puts "  estimated transfer #{human_size(volume)}"
+  end
+end
+
+def bare_repositories(backup_folder)
+  repositories = []
+
+  Find.find(backup_folder) do |path|
+    next unless File.directory?(path)
+    Find.prune if path == "#{backup_folder}/.ghbackup" || path.end_with?(".git.prev") || (File.dirname(path) == backup_folder && File.basename(path).start_with?("_"))
+
+    if File.file?("#{path}/HEAD") && File.directory?("#{path}/objects") && File.directory?("#{path}/refs")
+      repositories << path
+      Find.prune
+    end
+  end
+
+  repositories
+end
+
+def github_full_name(remote_url)
+  match = remote_url.to_s.strip.match(%r{github\.com[:/]([^/]+)/([^/]+?)(?:\.git)?/?$})
+  match && "#{match[1]}/#{match[2]}"
+end
+
+def adopt(mapping_file)
+  config = resolve_token(load_config)
+  backup_folder = config[:backup_folder]
+  mapping = mapping_file ? JSON.parse(File.read(mapping_file)) : {}
+
+  with_lock do
+    client = build_client(config)
+    login = account_login(client, config)
+    state = load_state(backup_folder)
+    adopted = state["adopted"] ||= {}
+
+    bare_repositories(backup_folder).each do |path|
+      relative_path = path.delete_prefix("#{backup_folder}/")
+      remote_url, _ = Open3.capture2('git', '-C', path, 'config', '--get', 'remote.origin.url')
+      full_name = mapping[relative_path] || github_full_name(remote_url)
+
+      if full_name.nil?
+        puts "Skipping #{relative_path}, unable to determine the GitHub repository"
+        next
+      end
+
+      target_path = mirror_path(config, full_name)
+      next if path == target_path && read_marker(path)["adopted"]
+
+      begin
+        repo = client.repository(full_name)
+      rescue Octokit::NotFound
+        puts "Skipping #{relative_path}, #{full_name} not found on GitHub"
+        next
+      end
+
+      if path != target_path
+        if File.exist?(target_path)
+          puts "Skipping #{relative_path}, #{full_name} is already backed up"
+          next
+        end
+
+        FileUtils.mkdir_p(File.dirname(target_path))
+        File.rename(path, target_path)
+      end
+
+      remote = authenticated_url(config, repo[:clone_url], login)
+
+      if remote_url.strip.empty?
+        system('git', '-C', target_path, 'remote', 'add', '--mirror=fetch', 'origin', remote)
+      else
+        system('git', '-C', target_path, 'remote', 'set-url', 'origin', remote)
+        system('git', '-C', target_path, 'config', 'remote.origin.fetch', '+refs/*:refs/*')
+        system('git', '-C', target_path, 'config', 'remote.origin.mirror', 'true')
+      end
+
+      FileUtils.touch("#{target_path}/git-daemon-export-ok")
+
+      adopted[full_name] = { "from" => relative_path, "at" => Time.now.utc.iso8601 }
+      write_marker(target_path, "id" => repo[:id], "full_name" => repo[:full_name], "normalized" => config[:name_normalization], "adopted" => adopted[full_name])
+      save_state(backup_folder, state)
+
+      puts "Adopted #{relative_path} as #{full_name}"
+    end
+  end
+end
+
+def migrate_to_encrypted(config)
+  backup_folder = config[:backup_folder]
+  manifest = load_manifest(backup_folder)
+
+  mirror_paths(backup_folder).each do |full_name, path|
+    artifact = artifact_name(stored_name(config, full_name), nil)
+    artifact_path = "#{backup_folder}/#{artifact}"
+    bundle_path = "#{workspace(config)}/#{full_name}.migrate.bundle"
+
+    begin
+      FileUtils.mkdir_p(File.dirname(bundle_path))
+
+      migrated = system('git', '-C', path, 'bundle', 'create', bundle_path, '--all') &&
+        system('git', '-C', path, 'bundle', 'verify', bundle_path) &&
+        system('age', *recipient_args(config[:age_recipients]), '-o', "#{artifact_path}.tmp", bundle_path)
+
+      if migrated
+        File.rename("#{artifact_path}.tmp", artifact_path)
+        record_artifact(manifest, full_name, artifact, config[:key_generation], nil)
+        save_manifest(backup_folder, manifest)
+        FileUtils.rm_rf(path)
+
+        puts "Migrated #{full_name} to #{artifact}"
+      else
+        FileUtils.rm_f("#{artifact_path}.tmp")
+        puts "Unable to migrate #{full_name}"
+      end
+    ensure
+      FileUtils.rm_f(bundle_path)
+    end
+  end
+end
+
+def migrate_to_plaintext(config)
+  config = resolve_token(config)
+  backup_folder = config[:backup_folder]
+  manifest = load_manifest(backup_folder)
+  login = account_login(build_client(config), config)
+
+  manifest["artifacts"].select { |_, artifact| artifact["run_tag"].nil? }.each do |full_name, artifact|
+    artifact_path = "#{backup_folder}/#{artifact["path"]}"
+    bundle_path = "#{workspace(config)}/#{full_name}.migrate.bundle"
+    target_path = mirror_path(config, full_name)
+    work_path = "#{target_path}.migrating"
+
+    next if Dir.exist?(target_path)
+
+    begin
+      FileUtils.mkdir_p(File.dirname(bundle_path))
+      FileUtils.rm_rf(work_path)
+
+      migrated = system('age', '-d', '-i', config[:age_identity], '-o', bundle_path, artifact_path) &&
+        system('git', 'clone', '--mirror', bundle_path, work_path) &&
+        system('git', '-C', work_path, 'fsck', '--no-progress')
+
+      if migrated
+        remote = authenticated_url(config, "https://github.com/#{full_name}.git", login)
+        system('git', '-C', work_path, 'remote', 'set-url', 'origin', remote)
+        FileUtils.touch("#{work_path}/git-daemon-export-ok")
+        write_marker(work_path, "full_name" => full_name, "normalized" => config[:name_normalization])
+
+        File.rename(work_path, target_path)
+        FileUtils.rm_f(artifact_path)
+        manifest["artifacts"].delete(full_name)
+        save_manifest(backup_folder, manifest)
+
+        puts "Migrated #{full_name} to #{target_path.delete_prefix("#{backup_folder}/")}"
+      else
+        FileUtils.rm_rf(work_path)
+        puts "Unable to migrate #{full_name}"
+      end
+    ensure
+      FileUtils.rm_f(bundle_path)
+    end
+  end
+end
+
+# Moves mirrors that aren't where LAYOUT expects them, in either direction,
+# removing the directories left empty behind them.
+def migrate_layout(config)
+  moved = mirror_paths(config[:backup_folder]).count do |full_name, path|
+    target_path = mirror_path(config, full_name)
+    next false if path == target_path
+
+    if File.exist?(target_path)
+      puts "Skipping #{full_name}, #{target_path} already exists"
+      next false
+    end
+
+    FileUtils.mkdir_p(File.dirname(target_path))
+    File.rename(path, target_path)
+    File.rename("#{path}.prev", "#{target_path}.prev") if Dir.exist?("#{path}.prev")
+    write_marker(target_path, "full_name" => full_name, "normalized" => config[:name_normalization])
+    puts "Moved #{full_name} to #{target_path.delete_prefix("#{config[:backup_folder]}/")}"
+
+    [["_metadata", ""], ["_delayed", ".git"]].each do |folder, suffix|
+      from = "#{config[:backup_folder]}/#{folder}/#{full_name}#{suffix}"
+      to = "#{config[:backup_folder]}/#{folder}/#{stored_name(config, full_name)}#{suffix}"
+      next if from == to || !File.exist?(from) || File.exist?(to)
+
+      FileUtils.mkdir_p(File.dirname(to))
+      File.rename(from, to)
+    end
+
+    [File.dirname(path), File.dirname(File.dirname(path))].each do |directory|
+      break if directory == config[:backup_folder] || !Dir.empty?(directory)
+      Dir.rmdir(directory)
+    end
+
+    true
+  end
+
+  moved > 0
+end
+
+def migrate
+  config = load_config
+
+  with_lock do
+    moved = migrate_layout(config)
+
+    if config[:age_recipients].any?
+      migrate_to_encrypted(config)
+    elsif config[:age_identity]
+      migrate_to_plaintext(config)
+    elsif !moved
+      puts "Nothing to migrate"
+    end
+  end
+end
+
+def disk_usage(path)
+  return File.size(path) if File.file?(path)
+
+  total = 0
+  linked = {}
+
+  Find.find(path) do |file|
+    stat = File.lstat(file)
+    next unless stat.file?
+    next if stat.nlink > 1 && linked.key?([stat.dev, stat.ino])
+
+    linked[[stat.dev, stat.ino]] = true if stat.nlink > 1
+    total += stat.size
+  end
+
+  total
+end
+
+def human_size(bytes)
+  units = %w[B KB MB GB TB]
+  exponent = bytes.zero? ? 0 : [(Math.log(bytes) / Math.log(1024)).floor, units.size - 1].min
+
+  format("%.1f %s", bytes.to_f / 1024**exponent, units[exponent])
+end
+
+# Records the backups of repositories that are no longer listed as pending
+# deletion, counting the runs they've been missing for. Repositories that show
+# up again are removed from the list.
+def mark_orphans(config, state, listed)
+  backup_folder = config[:backup_folder]
+  names = mirror_paths(backup_folder).map(&:first)
+  names += metadata_folders(config, listed).map(&:first)
+  names += load_manifest(backup_folder)["artifacts"].keys.map { |key| key.split("@").first }
+
+  orphans = names.uniq - listed
+  pending = state["pending_deletion"] ||= {}
+  pending.select! { |full_name, _| orphans.include?(full_name) }
+
+  orphans.each do |full_name|
+    entry = pending[full_name] ||= { "since" => Time.now.utc.iso8601, "runs" => 0 }
+    entry["runs"] += 1
+  end
+
+  pending
+end
+
+def prune_allowed?(config, state, full_name)
+  return true if config[:prune_grace] <= 0
+
+  entry = (state["pending_deletion"] || {})[full_name]
+  !entry.nil? && entry["runs"] >= 2 && Time.now.utc - Time.parse(entry["since"]) >= config[:prune_grace] * 86400
+end
+
+def prune_candidates(config)
+  backup_folder = config[:backup_folder]
+  manifest = load_manifest(backup_folder)
+  state = load_state(backup_folder)
+  listed = list_repositories(build_client(config), config).map { |repo| repo[:full_name] }
+  candidates = []
+
+  mirror_paths(backup_folder).each do |full_name, path|
+    next if listed.include?(full_name)
+
+    adopted = read_marker(path)["adopted"]
+    reason = adopted ? "orphaned mirror of #{full_name}, adopted from #{adopted["from"]}" : "orphaned mirror of #{full_name}"
+    candidates << { reason: reason, path: path, full_name: full_name, adopted: !adopted.nil? }
+  end
+
+  metadata_folders(config, listed).each do |full_name, path|
+    next if listed.include?(full_name)
+
+    candidates << { reason: "orphaned metadata of #{full_name}", path: path, full_name: full_name }
+  end
+
+  manifest["artifacts"].each do |key, artifact|
+    full_name = key.split("@").first
+    path = "#{backup_folder}/#{artifact["path"]}"
+    next unless File.exist?(path)
+
+    if !listed.include?(full_name)
+      candidates << { reason: "orphaned archive of #{full_name}", path: path, artifact: key, full_name: full_name }
+    elsif artifact["run_tag"] && Time.now.utc - Time.parse(artifact["updated_at"]) > config[:prune_archive_days] * 86400
+      candidates << { reason: "old archive #{artifact["path"]}", path: path, artifact: key }
+    end
+  end
+
+  Dir.glob(["#{backup_folder}/*/*.git.prev", "#{backup_folder}/*/*/*.git.prev"]).sort.each do |path|
+    next if config[:keep_previous] && Dir.exist?(path.delete_suffix(".prev"))
+
+    candidates << { reason: "previous copy #{path.delete_prefix("#{backup_folder}/")}", path: path }
+  end
+
+  partials = Dir.glob(["#{backup_folder}/**/*.tmp", "#{backup_folder}/*/*.migrating"]) + stale_workspaces(config)
+  partials.sort.each do |path|
+    candidates << { reason: "stale partial #{path}", path: path }
+  end
+
+  candidates.each do |candidate|
+    candidate[:held] = !candidate[:full_name].nil? && !prune_allowed?(config, state, candidate[:full_name])
+  end
+end
+
+def prune(options)
+  config = resolve_token(load_config)
+
+  with_lock do
+    manifest = load_manifest(config[:backup_folder])
+    held, candidates = prune_candidates(config).partition { |candidate| candidate[:held] }
+    held.each { |candidate| puts "Keeping #{candidate[:reason]}, pending deletion for PRUNE_GRACE" }
+
+    if candidates.empty?
+      puts "Nothing to prune"
+      next
+    end
+
+    candidates.each { |candidate| candidate[:size] = disk_usage(candidate[:path]) }
+    candidates.each { |candidate| puts "#{human_size(candidate[:size]).rjust(10)}  #{candidate[:reason]}" }
+    puts "#{human_size(candidates.sum { |candidate| candidate[:size] }).rjust(10)}  total"
+
+    next unless options.include?("--yes") || options.include?("--interactive")
+
+    candidates.each do |candidate|
+      if candidate[:adopted] && !options.include?("--interactive")
+        puts "Keeping #{candidate[:reason]}, adopted mirrors are only removed with --interactive"
+        next
+      end
+
+      if !options.include?("--yes")
+        print "Remove #{candidate[:reason]} (#{human_size(candidate[:size])})? [y/N] "
+        next unless $stdin.gets.to_s.strip.downcase == "y"
+      end
+
+      FileUtils.rm_rf(candidate[:path])
+      manifest["artifacts"].delete(candidate[:artifact]) if candidate[:artifact]
+      puts "Removed #{candidate[:reason]}"
+    end
+
+    save_manifest(config[:backup_folder], manifest)
+  end
+end
+
+def list_runs(run_tag)
+  load_tenants.each do |name, config|
+    runs = load_state(config[:backup_folder])["runs"] || []
+    runs = runs.select { |run| run["run_tag"] == run_tag } if run_tag
+
+    runs.each do |run|
+      puts [name, run["started_at"], run["run_tag"] || "-", "#{run["repositories"]} repositories", "#{run["failed"].size} failed"].join("\t")
+    end
+  end
+end
+
+def verify
+  config = load_config
+  state = load_state(config[:backup_folder])
+  verified = state["verified"] ||= {}
+  failed = []
+
+  with_lock do
+    mirror_paths(config[:backup_folder]).each do |full_name, path|
+      refs = read_marker(path)["refs"]
+      puts "Verifying #{full_name}#{" (partial: #{refs.join(", ")})" if refs}..."
+
+      ok = system('git', '-C', path, 'fsck', '--no-progress')
+      failed << full_name unless ok
+
+      verified[full_name] = { "at" => Time.now.utc.iso8601, "ok" => ok }
+    end
+
+    save_state(config[:backup_folder], state) unless config[:read_only]
+  end
+
+  failed.each { |full_name| puts "Verification failed for #{full_name}" }
+  exit 1 if failed.any?
+end
+
+# Problems found in a mirror by a full fsck, by comparing its branches with the
+# tips recorded after the last fetch and, when it has LFS objects, by git lfs
+# fsck.
+def mirror_problems(path, tips)
+  problems = []
+
+  output, status = Open3.capture2e('git', '-C', path, 'fsck', '--full', '--no-progress', '--no-dangling')
+  problems << ["fsck", output.lines.last.to_s.strip] unless status.success?
+
+  current = branch_tips(path)
+  changed = (tips || {}).reject { |branch, tip| current[branch] == tip && system('git', '-C', path, 'cat-file', '-e', "#{tip}^{commit}", err: File::NULL) }
+  problems << ["refs", "#{changed.keys.join(", ")} changed since the last fetch"] if changed.any?
+
+  if git_lfs_version && Dir.exist?("#{path}/lfs/objects")
+    output, status = Open3.capture2e('git', '-C', path, 'lfs', 'fsck')
+    problems << ["lfs", output.lines.last.to_s.strip] unless status.success?
+  end
+
+  problems
+end
+
+def log_repair(config, full_name, check, action, ok)
+  puts "#{ok ? "Repaired" : "Unable to repair"} #{full_name} (#{check}), #{action}"
+
+  path = "#{config[:backup_folder]}/.ghbackup/repairs.ndjson"
+  FileUtils.mkdir_p(File.dirname(path))
+  File.open(path, "a") do |file|
+    file.puts({ "at" => Time.now.utc.iso8601, "repository" => full_name, "check" => check, "action" => action, "ok" => ok }.to_json)
+  end
+end
+
+# Repairs a mirror in steps, each more expensive than the last: missing LFS
+# objects are downloaded again, then every object is fetched again (git 2.36
+# or newer) and finally the mirror is cloned from scratch. The broken mirror
+# is kept until the new clone checks out.
+def repair_mirror(config, state, client, login, full_name, path, problems)
+  check = problems.map(&:first).join(", ")
+  repo = client.repository(full_name)
+  execute('git', '-C', path, 'remote', 'set-url', 'origin', authenticated_url(config, repo[:clone_url], login))
+
+  if problems.all? { |problem, _| problem == "lfs" }
+    ok = execute('git', '-C', path, 'lfs', 'fetch', '--all', 'origin') && mirror_problems(path, state.dig("tips", full_name)).empty?
+    log_repair(config, full_name, check, "downloaded the LFS objects again", ok)
+    return true if ok
+  end
+
+  if git_at_least?("2.36.0")
+    ok = execute('git', '-C', path, 'fetch', '--refetch', '--prune', 'origin') && mirror_problems(path, state.dig("tips", full_name)).empty?
+    log_repair(config, full_name, check, "fetched every object again", ok)
+    return true if ok
+  end
+
+  FileUtils.rm_rf("#{path}.broken")
+  FileUtils.mv(path, "#{path}.broken")
+  failed = backup_by_name(config, client, state, login, [full_name])
+  ok = failed.empty? && Dir.exist?(path) && mirror_problems(path, state.dig("tips", full_name)).empty?
+
+  if ok
+    FileUtils.rm_rf("#{path}.broken")
+  else
+    FileUtils.rm_rf(path)
+    FileUtils.mv("#{path}.broken", path)
+  end
+
+  log_repair(config, full_name, check, "cloned the mirror again", ok)
+  ok
+rescue Octokit::NotFound
+  log_repair(config, full_name, check, "the repository is no longer accessible", false)
+  false
+end
+
+# Checks every mirror and encrypted artifact in full, repairing what it can
+# when a client is given. Returns the problems that are left.
+def deep_verify(config, state, client, login)
+  left = []
+
+  mirror_paths(config[:backup_folder]).each do |full_name, path|
+    puts "Deep verifying #{full_name}..."
+    problems = mirror_problems(path, state.dig("tips", full_name))
+    next if problems.empty?
+    next if client && !repository_frozen?(config, state, full_name) && repair_mirror(config, state, client, login, full_name, path, problems)
+
+    left += problems.map { |check, detail| "#{full_name} (#{check}: #{detail})" }
+  end
+
+  load_manifest(config[:backup_folder])["artifacts"].each do |key, artifact|
+    next if artifact["sha256"].nil?
+
+    path = "#{config[:backup_folder]}/#{artifact["path"]}"
+    next if File.exist?(path) && Digest::SHA256.file(path).hexdigest == artifact["sha256"]
+
+    full_name = key.split("@").first
+
+    if client && artifact["run_tag"] == config[:run_tag] && !repository_frozen?(config, state, full_name)
+      ok = backup_by_name(config, client, state, login, [full_name]).empty?
+      log_repair(config, full_name, "checksum", "backed up again", ok)
+      next if ok
+    end
+
+    left << "#{key} (checksum: #{File.exist?(path) ? "doesn't match the manifest" : "missing"})"
+  end
+
+  state["deep_verified"] = Time.now.utc.iso8601
+  left
+end
+
+def deep_verify_due?(config, state)
+  state["deep_verified"].nil? || Time.now.utc - Time.parse(state["deep_verified"]) >= config[:deep_verify_interval] * 86400
+end
+
+def deep_verify_command(repair)
+  abort "Repairs change the backup folder, they can't be made with READ_ONLY=true" if repair && load_config[:read_only]
+
+  left = []
+
+  with_lock do
+    load_tenants.each do |name, config|
+      state = load_state(config[:backup_folder])
+      client = nil
+      login = nil
+
+      if repair && !config[:source_dir]
+        config = resolve_token(config)
+        client = build_client(config)
+        login = cached_login(client, config, state)
+      end
+
+      left += deep_verify(config, state, client, login).map { |problem| "#{name}: #{problem}" }
+      save_state(config[:backup_folder], state) unless config[:read_only]
+    end
+  end
+
+  left.each { |problem| puts "Deep verification failed for #{problem}" }
+  exit 1 if left.any?
+rescue Octokit::Error, Faraday::Error, TokenProviderError => e
+  abort "Deep verification failed: #{e.message}"
+end
+
+def mirror_refs(path)
+  output, _ = Open3.capture2('git', '-C', path, 'for-each-ref', '--format=%(refname) %(objectname)')
+  output.lines.map(&:split).to_h
+end
+
+def ancestor?(path, ancestor, descendant)
+  system('git', '-C', path, 'merge-base', '--is-ancestor', ancestor, descendant, err: File::NULL)
+end
+
+def compare_refs(path_a, path_b)
+  refs_a = mirror_refs(path_a)
+  refs_b = mirror_refs(path_b)
+
+  (refs_a.keys | refs_b.keys).sort.map do |ref|
+    sha_a = refs_a[ref]
+    sha_b = refs_b[ref]
+    next if sha_a == sha_b
+
+    difference = if sha_b.nil?
+      "missing from B"
+    elsif sha_a.nil?
+      "missing from A"
+    elsif ancestor?(path_a, sha_b, sha_a)
+      "B is behind"
+    elsif ancestor?(path_b, sha_a, sha_b)
+      "A is behind"
+    else
+      "diverged"
+    end
+
+    "#{ref} #{difference}"
+  end.compact
+end
+
+# The digest of an artifact as it is on disk, the manifest's copy isn't used
+# as the file may not match it on a replica.
+def artifact_digest(backup_folder, artifact)
+  path = "#{backup_folder}/#{artifact["path"]}"
+  File.exist?(path) ? Digest::SHA256.file(path).hexdigest : nil
+end
+
+def compare(path_a, path_b)
+  abort "Usage: ghbackup compare <pathA> <pathB>" if path_a.nil? || path_b.nil?
+
+  mirrors_a = mirror_paths(path_a).to_h
+  mirrors_b = mirror_paths(path_b).to_h
+  differences = 0
+
+  (mirrors_a.keys | mirrors_b.keys).sort.each do |full_name|
+    if mirrors_b[full_name].nil?
+      puts "#{full_name}: missing from B"
+    elsif mirrors_a[full_name].nil?
+      puts "#{full_name}: missing from A"
+    else
+      refs = compare_refs(mirrors_a[full_name], mirrors_b[full_name])
+      next if refs.empty?
+
+      puts "#{full_name}: #{refs.size} refs differ"
+      refs.each { |ref| puts "  #{ref}" }
+    end
+
+    differences += 1
+  end
+
+  artifacts_a = load_manifest(path_a)["artifacts"]
+  artifacts_b = load_manifest(path_b)["artifacts"]
+
+  (artifacts_a.keys | artifacts_b.keys).sort.each do |key|
+    if artifacts_b[key].nil?
+      puts "#{key}: encrypted artifact missing from B"
+    elsif artifacts_a[key].nil?
+      puts "#{key}: encrypted artifact missing from A"
+    elsif (digest_a = artifact_digest(path_a, artifacts_a[key])).nil?
+      puts "#{key}: encrypted artifact #{artifacts_a[key]["path"]} missing from A"
+    elsif (digest_b = artifact_digest(path_b, artifacts_b[key])).nil?
+      puts "#{key}: encrypted artifact #{artifacts_b[key]["path"]} missing from B"
+    elsif digest_a != digest_b
+      puts "#{key}: encrypted artifact differs, updated at #{artifacts_a[key]["updated_at"]} in A and #{artifacts_b[key]["updated_at"]} in B"
+    else
+      next
+    end
+
+    differences += 1
+  end
+
+  puts "#{differences} differences between #{path_a} and #{path_b}"
+  exit 1 if differences > 0
+end
+
+def version
+  details = [REVISION.empty? ? nil : REVISION, BUILD_DATE && "built #{BUILD_DATE}"].compact
+  puts "ghbackup #{VERSION}#{" (#{details.join(", ")})" if details.any?}"
+  puts "ruby #{RUBY_VERSION}, octokit #{Octokit::VERSION}"
+  puts "git #{git_version || "not installed"}, git-lfs #{git_lfs_version || "not installed"}"
+end
+
+def self_update
+  if File.exist?("/.dockerenv") || ENV["GHBACKUP_VERSION"]
+    abort "self-update is disabled inside containers, pull a newer image instead"
+  end
+
+  client = Octokit::Client.new(user_agent: user_agent(load_config))
+  release = client.latest_release(RELEASES_REPOSITORY)
+  latest = release[:tag_name].delete_prefix("v")
+
+  if latest == VERSION
+    puts "Already up to date (#{VERSION})"
+    return
+  end
+
+  # Each release publishes the checksum of its script, a release without one
+  # isn't installed
+  checksum = release[:assets].find { |asset| asset[:name] == "ghbackup.rb.sha256" }
+  abort "Release #{release[:tag_name]} has no published checksum, not updating" if checksum.nil?
+
+  expected = client.get(checksum[:url], accept: "application/octet-stream").to_s.split.first
+
+  uri = URI("https://raw.githubusercontent.com/#{RELEASES_REPOSITORY}/#{release[:tag_name]}/ghbackup.rb")
+  response = Net::HTTP.get_response(uri)
+  abort "Unable to download #{uri}: #{response.code}" unless response.is_a?(Net::HTTPSuccess)
+  abort "The downloaded script doesn't match the checksum published with #{release[:tag_name]}, not updating" unless Digest::SHA256.hexdigest(response.body) == expected
+
+  script = File.realpath(__FILE__)
+  File.write("#{script}.tmp", response.body.sub('|| "dev"', "|| #{latest.to_json}"))
+  File.chmod(File.stat(script).mode, "#{script}.tmp")
+  File.rename("#{script}.tmp", script)
+
+  puts "Updated from #{VERSION} to #{latest}"
+rescue Octokit::Error, Faraday::Error, SystemCallError => e
+  abort "Unable to update: #{e.message}"
+end
+
+def healthcheck
+  healthy = true
+
+  load_tenants.each do |name, config|
+    last_run = load_state(config[:backup_folder])["last_run"]
+    next if last_run.nil?
+
+    age = Time.now.utc - Time.parse(last_run["started_at"])
+    max_age = [config[:healthcheck_max_age], config[:backup_interval]].max * 3600
+
+    if age > max_age
+      puts "#{name}: last run started #{(age / 3600).round(1)} hours ago"
+      healthy = false
+    end
+
+    if last_run["failed"].any?
+      puts "#{name}: #{last_run["failed"].size} repositories failed in the last run"
+      healthy = false
+    end
+  end
+
+  exit(healthy ? 0 : 1)
+end
+
+ensure_home
+configure_git
+
+if load_config[:output] == "jsonl"
+  $events = $stdout.dup
+  $events.sync = true
+  $stdout.reopen($stderr)
+end
+
+if load_config[:read_only] && !READ_ONLY_COMMANDS.include?(ARGV[0])
+  abort "READ_ONLY is set, refusing to run #{ARGV[0] || "backup"}"
+end
+
+(deprecation_warnings + lfs_warnings).each { |warning| annotate(load_config, "warning", warning) }
+load_config[:notifier_plugins].each { |path| require File.expand_path(path) }
+
+case ARGV[0]
+when "restore"
+  restore(ARGV[1], ARGV[2])
+when "rekey"
+  rekey
+when "cat"
+  cat(ARGV[1], ARGV[2], ARGV[3])
+when "checkout"
+  ref = ARGV.include?("--ref") ? ARGV[ARGV.index("--ref") + 1] : nil
+  abort "Usage: ghbackup checkout <owner>/<repo> <destination> [--ref <ref>]" if ARGV.include?("--ref") && ref.nil?
+
+  checkout(ARGV[1], ARGV[2], ref)
+when "search"
+  search(ARGV[1])
+when "serve"
+  serve
+when "status"
+  status(ARGV[1..-1])
+when "simulate"
+  simulate
+when "check-listing"
+  check_listing
+when "list-runs"
+  list_runs(ARGV[1])
+when "adopt"
+  adopt(ARGV[1])
+when "migrate"
+  migrate
+when "prune"
+  prune(ARGV[1..-1])
+when "login"
+  login
+when "verify"
+  verify
+when "deep-verify"
+  deep_verify_command(ARGV.include?("--repair"))
+when "compare"
+  compare(ARGV[1], ARGV[2])
+when "version"
+  version
+when "acknowledge"
+  acknowledge(ARGV[1])
+when "approve"
+  approve(ARGV[1])
+when "freeze"
+  set_frozen(ARGV[1], ARGV[2], true)
+when "unfreeze"
+  set_frozen(ARGV[1], nil, false)
+when "restore-settings"
+  restore_settings(ARGV[1], ARGV[2])
+when "self-update"
+  self_update
+when "healthcheck"
+  healthcheck
+when "config"
+  case ARGV[1]
+  when "migrate"
+    config_migrate(ARGV[2])
+  when "docs"
+    abort "Usage: ghbackup config docs [--json]" unless [nil, "--json"].include?(ARGV[2])
+
+    config_docs(ARGV[2] == "--json" ? "json" : "markdown")
+  else
+    abort "Usage: ghbackup config migrate [<output>] | docs [--json]"
+  end
+when "backup"
+  repo = ARGV.include?("--repo") ? ARGV[ARGV.index("--repo") + 1] : load_config[:repo]
+  source_dir = ARGV.include?("--source-dir") ? ARGV[ARGV.index("--source-dir") + 1] : load_config[:source_dir]
+  abort "Usage: ghbackup backup [--repo <owner>/<repo>] [--source-dir <path>]" if (ARGV.include?("--repo") && repo.nil?) || (ARGV.include?("--source-dir") && source_dir.nil?)
+
+  abort "--repo and --source-dir can't be used together" if repo && source_dir
+
+  ENV["SOURCE_DIR"] = source_dir
+
+  repo ? backup_single(repo) : backup
+else
+  if load_config[:repo]
+    backup_single(load_config[:repo])
+  elsif load_config[:mode] == "events"
+    watch_events
+  else
+    backup
+  end
+end